@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"info7255-bigdata-app/elastic"
+	"info7255-bigdata-app/models"
+	"log"
+	"net/http"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// bulkAction is one line pair of a _bulk request.
+type bulkAction struct {
+	// Op is "index" or "delete".
+	Op       string
+	Document elastic.Document
+}
+
+type bulkItem struct {
+	ID     string          `json:"_id"`
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error,omitempty"`
+}
+
+type bulkResponse struct {
+	Errors bool                  `json:"errors"`
+	Items  []map[string]bulkItem `json:"items"`
+}
+
+// bulkIndexer collects the actions of several messages into one _bulk
+// request. Each delivery is settled once the outcome of all its items is
+// known, so a message is only acked after every document it touches made it.
+type bulkIndexer struct {
+	es         *elasticsearch.Client
+	maxActions int
+	settle     func(d amqp.Delivery, err error)
+
+	body       bytes.Buffer
+	deliveries []amqp.Delivery
+	// owners[i] is the index in deliveries of the message bulk item i came from.
+	owners []int
+	ops    []string
+}
+
+func newBulkIndexer(es *elasticsearch.Client, maxActions int, settle func(d amqp.Delivery, err error)) *bulkIndexer {
+	return &bulkIndexer{
+		es:         es,
+		maxActions: maxActions,
+		settle:     settle,
+	}
+}
+
+// Add queues the actions of d and flushes once maxActions is reached. A
+// message that cannot be turned into actions is settled right away.
+func (b *bulkIndexer) Add(d amqp.Delivery) {
+	actions, err := actionsFor(d)
+	if err != nil {
+		b.settle(d, err)
+		return
+	}
+
+	var lines bytes.Buffer
+	for _, action := range actions {
+		if err := writeAction(&lines, action); err != nil {
+			b.settle(d, err)
+			return
+		}
+	}
+
+	owner := len(b.deliveries)
+	b.deliveries = append(b.deliveries, d)
+	b.body.Write(lines.Bytes())
+	for _, action := range actions {
+		b.owners = append(b.owners, owner)
+		b.ops = append(b.ops, action.Op)
+	}
+
+	if len(b.owners) >= b.maxActions {
+		b.Flush()
+	}
+}
+
+// Flush sends the queued actions and settles every queued delivery.
+func (b *bulkIndexer) Flush() {
+	if len(b.deliveries) == 0 {
+		return
+	}
+	defer b.reset()
+
+	errs := b.send()
+	for i, d := range b.deliveries {
+		b.settle(d, errs[i])
+	}
+}
+
+// send runs the _bulk request and returns the error of every queued delivery.
+func (b *bulkIndexer) send() []error {
+	errs := make([]error, len(b.deliveries))
+	failAll := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	res, err := b.es.Bulk(bytes.NewReader(b.body.Bytes()), b.es.Bulk.WithIndex(elastic.WriteAlias))
+	if err != nil {
+		return failAll(fmt.Errorf("error sending bulk request: %w", err))
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return failAll(statusError(res.StatusCode, "bulk request failed: %s", res.String()))
+	}
+
+	var parsed bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		return failAll(fmt.Errorf("error decoding bulk response: %w", err))
+	}
+	if len(parsed.Items) != len(b.owners) {
+		return failAll(fmt.Errorf("bulk response has %d items for %d actions", len(parsed.Items), len(b.owners)))
+	}
+
+	for i, result := range parsed.Items {
+		item := result[b.ops[i]]
+		if item.Status < 300 {
+			continue
+		}
+		// A document that is already gone is as good as deleted
+		if b.ops[i] == "delete" && item.Status == http.StatusNotFound {
+			continue
+		}
+		// The index already holds a newer version than this message
+		if item.Status == http.StatusConflict && errorType(item.Error) == "version_conflict_engine_exception" {
+			log.Printf("Skipping bulk %s of document ID=%s: a newer version is indexed", b.ops[i], item.ID)
+			continue
+		}
+
+		itemErr := statusError(item.Status, "error in bulk %s of document ID=%s: %s", b.ops[i], item.ID, item.Error)
+		owner := b.owners[i]
+		// Retrying cannot help a message with a poison item
+		if errs[owner] == nil || isPoison(itemErr) {
+			errs[owner] = itemErr
+		}
+	}
+
+	indexed := 0
+	for _, err := range errs {
+		if err == nil {
+			indexed++
+		}
+	}
+	log.Printf("Bulk request with %d actions: %d of %d messages succeeded", len(b.owners), indexed, len(b.deliveries))
+	return errs
+}
+
+// errorType returns the type of a bulk item error.
+func errorType(raw json.RawMessage) string {
+	var itemErr struct {
+		Type string `json:"type"`
+	}
+	if len(raw) == 0 || json.Unmarshal(raw, &itemErr) != nil {
+		return ""
+	}
+	return itemErr.Type
+}
+
+func (b *bulkIndexer) reset() {
+	b.body.Reset()
+	b.deliveries = b.deliveries[:0]
+	b.owners = b.owners[:0]
+	b.ops = b.ops[:0]
+}
+
+// actionsFor decodes a plan message into the bulk actions it needs. A panic
+// while doing so is turned into a poison error so it cannot stop the consumer.
+func actionsFor(d amqp.Delivery) (actions []bulkAction, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = poison("panic while processing message: %v", r)
+		}
+	}()
+
+	// Deserialize the PlanMessage
+	var planMessage models.PlanMessage
+	if err := json.Unmarshal(d.Body, &planMessage); err != nil {
+		return nil, poison("failed to deserialize PlanMessage: %v", err)
+	}
+
+	if err := elastic.CheckCommitTime(planMessage.CommittedAt); err != nil {
+		return nil, poison("%v", err)
+	}
+
+	var op string
+	switch planMessage.Operation {
+	case "create", "patch":
+		op = "index"
+	case "delete":
+		op = "delete"
+	default:
+		return nil, poison("unknown operation: %s", planMessage.Operation)
+	}
+
+	if planMessage.Plan != nil {
+		documents, err := elastic.Documents(planMessage.Plan)
+		if err != nil {
+			return nil, poison("failed to split the plan into documents: %v", err)
+		}
+		for _, document := range documents {
+			document.Version = planMessage.Versions[document.ObjectId]
+			actions = append(actions, bulkAction{Op: op, Document: document})
+		}
+	}
+	for _, ref := range planMessage.Removed {
+		document := elastic.Document{
+			ID:       elastic.DocumentID(ref.ID, ref.Routing),
+			ObjectId: ref.ID,
+			Routing:  ref.Routing,
+			Version:  planMessage.Versions[ref.ID],
+		}
+		if ref.DocumentId != "" && ref.DocumentId != document.ID {
+			// Nothing writes a document under an id the current layout
+			// does not produce, so no newer write can race its delete
+			document.ID = ref.DocumentId
+			document.Version = 0
+		}
+		actions = append(actions, bulkAction{Op: "delete", Document: document})
+	}
+
+	if len(actions) == 0 {
+		return nil, poison("message has neither a plan nor documents to remove")
+	}
+	return actions, nil
+}
+
+// writeAction appends the metadata line and, for index actions, the source
+// line of action to buf.
+func writeAction(buf *bytes.Buffer, action bulkAction) error {
+	meta := map[string]interface{}{"_id": action.Document.ID}
+	if action.Document.Routing != "" {
+		meta["routing"] = action.Document.Routing
+	}
+	if action.Document.Version > 0 {
+		// Elasticsearch only applies the write if the version is higher than
+		// the one it has, or remembers from a delete, so messages can be
+		// applied in any order
+		meta["version"] = action.Document.Version
+		meta["version_type"] = "external"
+	}
+
+	line, err := json.Marshal(map[string]interface{}{action.Op: meta})
+	if err != nil {
+		return poison("failed to serialize bulk action for document ID=%s: %v", action.Document.ID, err)
+	}
+	buf.Write(line)
+	buf.WriteByte('\n')
+
+	if action.Op != "index" {
+		return nil
+	}
+
+	// Serialize the object with the added plan_join field
+	source, err := json.Marshal(action.Document.Source)
+	if err != nil {
+		return poison("failed to serialize document ID=%s: %v", action.Document.ID, err)
+	}
+	buf.Write(source)
+	buf.WriteByte('\n')
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// config holds the consumer settings that can be overridden from the
+// environment.
+type config struct {
+	// Prefetch is how many unacknowledged messages the broker hands out at once.
+	Prefetch int
+	// MaxRetries is how often a failed message is retried before it is
+	// dead-lettered.
+	MaxRetries int
+	// RetryDelay is the wait before the first retry; it doubles every retry.
+	RetryDelay time.Duration
+	// BulkActions is how many actions are collected before a _bulk request
+	// is sent.
+	BulkActions int
+	// FlushInterval is how often collected actions are sent regardless of
+	// BulkActions.
+	FlushInterval time.Duration
+	// MetricsAddr is where the outcome counters are served.
+	MetricsAddr string
+}
+
+func loadConfig() config {
+	return config{
+		Prefetch:      envInt("CONSUMER_PREFETCH", 200),
+		MaxRetries:    envInt("CONSUMER_MAX_RETRIES", 5),
+		RetryDelay:    envDuration("CONSUMER_RETRY_DELAY", time.Second),
+		BulkActions:   envInt("CONSUMER_BULK_ACTIONS", 500),
+		FlushInterval: envDuration("CONSUMER_BULK_FLUSH_INTERVAL", time.Second),
+		MetricsAddr:   envString("CONSUMER_METRICS_ADDR", ":9102"),
+	}
+}
+
+// retryDelays returns the wait before each retry, doubling from RetryDelay.
+func (c config) retryDelays() []time.Duration {
+	delays := make([]time.Duration, c.MaxRetries)
+	delay := c.RetryDelay
+	for i := range delays {
+		delays[i] = delay
+		delay *= 2
+	}
+	return delays
+}
+
+func envString(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Fatalf("%s must be a non-negative integer, got %q", name, value)
+	}
+	return n
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Fatalf("%s must be a positive duration such as 1s, got %q", name, value)
+	}
+	return d
+}
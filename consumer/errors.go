@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// poisonError marks a failure that no retry can fix, such as a message that
+// does not decode or a document Elasticsearch rejects.
+type poisonError struct {
+	err error
+}
+
+func (e *poisonError) Error() string { return e.err.Error() }
+func (e *poisonError) Unwrap() error { return e.err }
+
+func poison(format string, args ...interface{}) error {
+	return &poisonError{err: fmt.Errorf(format, args...)}
+}
+
+// isPoison reports whether err, or anything it wraps, is a poison failure.
+// Everything else is treated as transient and retried.
+func isPoison(err error) bool {
+	var p *poisonError
+	return errors.As(err, &p)
+}
+
+// statusError classifies a failed Elasticsearch status. Throttling, timeouts,
+// version conflicts and server errors are transient; any other client error
+// means the request itself is wrong and resending it cannot help.
+func statusError(status int, format string, args ...interface{}) error {
+	switch {
+	case status == http.StatusTooManyRequests,
+		status == http.StatusRequestTimeout,
+		status == http.StatusConflict,
+		status >= 500:
+		return fmt.Errorf(format, args...)
+	default:
+		return poison(format, args...)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+)
+
+// outcomes counts how every message was settled. It is published by expvar
+// under "consumer" at /debug/vars.
+var outcomes = expvar.NewMap("consumer")
+
+const (
+	outcomeIndexed      = "indexed"
+	outcomeRetried      = "retried"
+	outcomeDeadLettered = "dead_lettered"
+	outcomeQuarantined  = "quarantined"
+	outcomeRequeued     = "requeued"
+)
+
+// inFlight counts the messages received but not settled yet, whether they
+// wait for a bulk request or for its response. The reindex command waits for
+// it to reach zero before it swaps the read alias.
+var inFlight = expvar.NewInt("consumer_in_flight")
+
+// publishRetryQueues publishes the names of the retry queues under
+// "consumer_retry_queues", so the reindex command can wait for them to empty.
+func publishRetryQueues(names []string) {
+	expvar.Publish("consumer_retry_queues", expvar.Func(func() any { return names }))
+}
+
+// serveMetrics exposes the expvar counters on addr until the process exits.
+func serveMetrics(addr string) {
+	log.Printf("Serving consumer metrics on %s/debug/vars", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		log.Printf("Metrics server stopped: %s", err)
+	}
+}
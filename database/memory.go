@@ -0,0 +1,487 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"info7255-bigdata-app/repositories"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryRepository is an in-process stand-in for RedisRepository. It keeps
+// the same semantics (KEY_NOT_FOUND errors, all-or-nothing batches) so the
+// services can be exercised without a Redis server. Keys never expire; use
+// Expire to simulate an expiry.
+type MemoryRepository struct {
+	mu      sync.Mutex
+	strings map[string]string
+	sets    map[string]map[string]bool
+	lists   map[string][]string
+	// zsets only ever hold score 0 members, the only kind RedisTx writes.
+	zsets map[string]map[string]bool
+
+	// expired holds the event channel of every SubscribeExpired call.
+	expired []chan string
+
+	// commitErr makes the next Batch fail at commit time, like an EXEC
+	// that never reaches the server.
+	commitErr error
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		strings: make(map[string]string),
+		sets:    make(map[string]map[string]bool),
+		lists:   make(map[string][]string),
+		zsets:   make(map[string]map[string]bool),
+	}
+}
+
+// FailNextCommit makes the next Batch return err without applying anything.
+func (m *MemoryRepository) FailNextCommit(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commitErr = err
+}
+
+func (m *MemoryRepository) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryRepository) Get(ctx context.Context, key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	val, ok := m.strings[key]
+	if !ok {
+		return "", errors.New("KEY_NOT_FOUND")
+	}
+	return val, nil
+}
+
+func (m *MemoryRepository) Set(ctx context.Context, key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.set(key, value)
+	return nil
+}
+
+func (m *MemoryRepository) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.del(key) == 0 {
+		return errors.New("KEY_NOT_FOUND")
+	}
+	return nil
+}
+
+func (m *MemoryRepository) Keys(ctx context.Context, pattern string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0)
+	for key := range m.strings {
+		if ok, _ := path.Match(pattern, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	for key := range m.sets {
+		if ok, _ := path.Match(pattern, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	for key := range m.lists {
+		if ok, _ := path.Match(pattern, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	for key := range m.zsets {
+		if ok, _ := path.Match(pattern, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *MemoryRepository) Incr(ctx context.Context, key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current := int64(0)
+	if val, ok := m.strings[key]; ok {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return 0, errors.New("ERR value is not an integer or out of range")
+		}
+		current = n
+	}
+	current++
+	m.strings[key] = strconv.FormatInt(current, 10)
+	return current, nil
+}
+
+func (m *MemoryRepository) SAdd(ctx context.Context, key string, members ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sadd(key, members...)
+	return nil
+}
+
+func (m *MemoryRepository) SMembers(ctx context.Context, key string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := make([]string, 0, len(m.sets[key]))
+	for member := range m.sets[key] {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+func (m *MemoryRepository) LRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := m.lists[key]
+	from, to, ok := listBounds(len(list), start, stop)
+	if !ok {
+		return []string{}, nil
+	}
+	return append([]string(nil), list[from:to]...), nil
+}
+
+func (m *MemoryRepository) ZRangeByLex(ctx context.Context, key, min, max string, count int64) ([]string, error) {
+	return m.zrangeByLex(key, min, max, count, false)
+}
+
+func (m *MemoryRepository) ZRevRangeByLex(ctx context.Context, key, max, min string, count int64) ([]string, error) {
+	return m.zrangeByLex(key, min, max, count, true)
+}
+
+func (m *MemoryRepository) zrangeByLex(key, min, max string, count int64, desc bool) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	above, err := lexBound(min, true)
+	if err != nil {
+		return nil, err
+	}
+	below, err := lexBound(max, false)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]string, 0, len(m.zsets[key]))
+	for member := range m.zsets[key] {
+		if above(member) && below(member) {
+			members = append(members, member)
+		}
+	}
+	sort.Strings(members)
+	if desc {
+		for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+			members[i], members[j] = members[j], members[i]
+		}
+	}
+	if count >= 0 && int64(len(members)) > count {
+		members = members[:count]
+	}
+	return members, nil
+}
+
+// SubscribeExpired reports the keys passed to Expire until ctx is done.
+func (m *MemoryRepository) SubscribeExpired(ctx context.Context, fn func(key string)) error {
+	m.mu.Lock()
+	events := make(chan string, 64)
+	m.expired = append(m.expired, events)
+	m.mu.Unlock()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case key := <-events:
+			fn(key)
+		}
+	}
+}
+
+// Expire deletes key as if its TTL ran out and notifies the subscribers.
+func (m *MemoryRepository) Expire(key string) {
+	m.mu.Lock()
+	m.del(key)
+	subscribers := append([]chan string(nil), m.expired...)
+	m.mu.Unlock()
+
+	for _, events := range subscribers {
+		events <- key
+	}
+}
+
+// Batch records the writes made by fn and applies them under a single lock,
+// so readers never observe a partially applied batch.
+func (m *MemoryRepository) Batch(ctx context.Context, fn func(tx repositories.RedisTx) error) error {
+	tx := &memoryTx{}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.commit(tx)
+}
+
+// Watch is Batch that fails with TX_CONFLICT when a watched key holds
+// something else at commit time than when it was watched.
+func (m *MemoryRepository) Watch(ctx context.Context, fn func(watch func(keys ...string) error, tx repositories.RedisTx) error) error {
+	tx := &memoryTx{}
+	watched := make(map[string]string)
+	watch := func(keys ...string) error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for _, key := range keys {
+			if _, ok := watched[key]; !ok {
+				watched[key] = m.dump(key)
+			}
+		}
+		return nil
+	}
+	if err := fn(watch, tx); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, value := range watched {
+		if m.dump(key) != value {
+			return errors.New("TX_CONFLICT")
+		}
+	}
+	return m.commit(tx)
+}
+
+func (m *MemoryRepository) commit(tx *memoryTx) error {
+	if m.commitErr != nil {
+		err := m.commitErr
+		m.commitErr = nil
+		return err
+	}
+	for _, op := range tx.ops {
+		op(m)
+	}
+	return nil
+}
+
+// dump renders whatever key holds, to tell whether it changed.
+func (m *MemoryRepository) dump(key string) string {
+	value, ok := m.strings[key]
+	return fmt.Sprint(ok, value, m.sets[key], m.lists[key], m.zsets[key])
+}
+
+func (m *MemoryRepository) set(key, value string) {
+	delete(m.sets, key)
+	delete(m.lists, key)
+	delete(m.zsets, key)
+	m.strings[key] = value
+}
+
+func (m *MemoryRepository) del(keys ...string) int {
+	removed := 0
+	for _, key := range keys {
+		if _, ok := m.strings[key]; ok {
+			delete(m.strings, key)
+			removed++
+		}
+		if _, ok := m.sets[key]; ok {
+			delete(m.sets, key)
+			removed++
+		}
+		if _, ok := m.lists[key]; ok {
+			delete(m.lists, key)
+			removed++
+		}
+		if _, ok := m.zsets[key]; ok {
+			delete(m.zsets, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (m *MemoryRepository) sadd(key string, members ...string) {
+	set, ok := m.sets[key]
+	if !ok {
+		set = make(map[string]bool)
+		m.sets[key] = set
+	}
+	for _, member := range members {
+		set[member] = true
+	}
+}
+
+func (m *MemoryRepository) srem(key string, members ...string) {
+	for _, member := range members {
+		delete(m.sets[key], member)
+	}
+	if len(m.sets[key]) == 0 {
+		delete(m.sets, key)
+	}
+}
+
+func (m *MemoryRepository) rpush(key string, values ...string) {
+	m.lists[key] = append(m.lists[key], values...)
+}
+
+func (m *MemoryRepository) lrem(key, value string) {
+	kept := m.lists[key][:0]
+	for _, v := range m.lists[key] {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	m.setList(key, kept)
+}
+
+func (m *MemoryRepository) ltrim(key string, start, stop int64) {
+	list := m.lists[key]
+	from, to, ok := listBounds(len(list), start, stop)
+	if !ok {
+		m.setList(key, nil)
+		return
+	}
+	m.setList(key, append([]string(nil), list[from:to]...))
+}
+
+// setList stores list, dropping the key once it is empty as Redis does.
+func (m *MemoryRepository) setList(key string, list []string) {
+	if len(list) == 0 {
+		delete(m.lists, key)
+		return
+	}
+	m.lists[key] = list
+}
+
+// listBounds converts Redis style inclusive, possibly negative, indexes into
+// a slice range.
+func listBounds(length int, start, stop int64) (int, int, bool) {
+	n := int64(length)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop || start >= n {
+		return 0, 0, false
+	}
+	return int(start), int(stop) + 1, true
+}
+
+func (m *MemoryRepository) zadd(key string, members ...string) {
+	zset, ok := m.zsets[key]
+	if !ok {
+		zset = make(map[string]bool)
+		m.zsets[key] = zset
+	}
+	for _, member := range members {
+		zset[member] = true
+	}
+}
+
+func (m *MemoryRepository) zrem(key string, members ...string) {
+	for _, member := range members {
+		delete(m.zsets[key], member)
+	}
+	if len(m.zsets[key]) == 0 {
+		delete(m.zsets, key)
+	}
+}
+
+// lexBound turns a Redis lexicographic range bound into a test. lower tells
+// whether it is the min or the max of the range.
+func lexBound(bound string, lower bool) (func(string) bool, error) {
+	switch {
+	case bound == "-":
+		return func(string) bool { return lower }, nil
+	case bound == "+":
+		return func(string) bool { return !lower }, nil
+	case bound == "":
+		return nil, errors.New("ERR min or max not valid string range item")
+	}
+
+	value := bound[1:]
+	switch bound[0] {
+	case '[':
+		if lower {
+			return func(member string) bool { return member >= value }, nil
+		}
+		return func(member string) bool { return member <= value }, nil
+	case '(':
+		if lower {
+			return func(member string) bool { return member > value }, nil
+		}
+		return func(member string) bool { return member < value }, nil
+	}
+	return nil, errors.New("ERR min or max not valid string range item")
+}
+
+type memoryTx struct {
+	ops []func(m *MemoryRepository)
+}
+
+func (t *memoryTx) Set(key, value string) {
+	t.ops = append(t.ops, func(m *MemoryRepository) { m.set(key, value) })
+}
+
+func (t *memoryTx) SetEx(key, value string, ttl time.Duration) {
+	t.Set(key, value)
+}
+
+func (t *memoryTx) Persist(key string) {}
+
+func (t *memoryTx) Delete(keys ...string) {
+	t.ops = append(t.ops, func(m *MemoryRepository) { m.del(keys...) })
+}
+
+func (t *memoryTx) SAdd(key string, members ...string) {
+	t.ops = append(t.ops, func(m *MemoryRepository) { m.sadd(key, members...) })
+}
+
+func (t *memoryTx) SRem(key string, members ...string) {
+	t.ops = append(t.ops, func(m *MemoryRepository) { m.srem(key, members...) })
+}
+
+func (t *memoryTx) RPush(key string, values ...string) {
+	t.ops = append(t.ops, func(m *MemoryRepository) { m.rpush(key, values...) })
+}
+
+func (t *memoryTx) LRem(key, value string) {
+	t.ops = append(t.ops, func(m *MemoryRepository) { m.lrem(key, value) })
+}
+
+func (t *memoryTx) LTrim(key string, start, stop int64) {
+	t.ops = append(t.ops, func(m *MemoryRepository) { m.ltrim(key, start, stop) })
+}
+
+func (t *memoryTx) ZAdd(key string, members ...string) {
+	t.ops = append(t.ops, func(m *MemoryRepository) { m.zadd(key, members...) })
+}
+
+func (t *memoryTx) ZRem(key string, members ...string) {
+	t.ops = append(t.ops, func(m *MemoryRepository) { m.zrem(key, members...) })
+}
@@ -0,0 +1,143 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"info7255-bigdata-app/repositories"
+	"reflect"
+	"testing"
+)
+
+func TestBatchCommitsEveryWrite(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryRepository()
+	if err := m.Set(ctx, "stale", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := m.Batch(ctx, func(tx repositories.RedisTx) error {
+		tx.Set("plan:1", "{}")
+		tx.SAdd("edges:1", "service:2")
+		tx.RPush("outbox:pending", "1")
+		tx.Delete("stale")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Batch: %v", err)
+	}
+
+	if value, err := m.Get(ctx, "plan:1"); err != nil || value != "{}" {
+		t.Errorf("Get(plan:1) = %q, %v, want {}", value, err)
+	}
+	if members, _ := m.SMembers(ctx, "edges:1"); !reflect.DeepEqual(members, []string{"service:2"}) {
+		t.Errorf("SMembers(edges:1) = %v, want [service:2]", members)
+	}
+	if ids, _ := m.LRange(ctx, "outbox:pending", 0, -1); !reflect.DeepEqual(ids, []string{"1"}) {
+		t.Errorf("LRange(outbox:pending) = %v, want [1]", ids)
+	}
+	if _, err := m.Get(ctx, "stale"); err == nil || err.Error() != "KEY_NOT_FOUND" {
+		t.Errorf("Get(stale) = %v, want KEY_NOT_FOUND", err)
+	}
+}
+
+func TestBatchRollsBack(t *testing.T) {
+	ctx := context.Background()
+	writes := func(tx repositories.RedisTx) {
+		tx.Set("plan:1", "{}")
+		tx.SAdd("edges:1", "service:2")
+		tx.RPush("outbox:pending", "1")
+	}
+
+	t.Run("fn fails", func(t *testing.T) {
+		m := NewMemoryRepository()
+		failure := errors.New("validation failed")
+		err := m.Batch(ctx, func(tx repositories.RedisTx) error {
+			writes(tx)
+			return failure
+		})
+		if err != failure {
+			t.Fatalf("Batch = %v, want %v", err, failure)
+		}
+		if keys, _ := m.Keys(ctx, "*"); len(keys) != 0 {
+			t.Errorf("Keys after a failed batch = %v, want none", keys)
+		}
+	})
+
+	t.Run("commit fails", func(t *testing.T) {
+		m := NewMemoryRepository()
+		failure := errors.New("connection reset")
+		m.FailNextCommit(failure)
+		err := m.Batch(ctx, func(tx repositories.RedisTx) error {
+			writes(tx)
+			return nil
+		})
+		if err != failure {
+			t.Fatalf("Batch = %v, want %v", err, failure)
+		}
+		if keys, _ := m.Keys(ctx, "*"); len(keys) != 0 {
+			t.Errorf("Keys after a failed commit = %v, want none", keys)
+		}
+
+		// Only the next commit fails
+		err = m.Batch(ctx, func(tx repositories.RedisTx) error {
+			writes(tx)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Batch after the failed commit: %v", err)
+		}
+		if keys, _ := m.Keys(ctx, "*"); len(keys) != 3 {
+			t.Errorf("Keys = %v, want the 3 written keys", keys)
+		}
+	})
+}
+
+func TestWatchConflicts(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		change   func(m *MemoryRepository)
+		conflict bool
+	}{
+		{"unchanged", func(m *MemoryRepository) {}, false},
+		{"written again with the same value", func(m *MemoryRepository) { m.Set(ctx, "version:1", "1") }, false},
+		{"string changed", func(m *MemoryRepository) { m.Set(ctx, "version:1", "2") }, true},
+		{"string deleted", func(m *MemoryRepository) { m.Delete(ctx, "version:1") }, true},
+		{"set changed", func(m *MemoryRepository) { m.SAdd(ctx, "parents:2", "plan:3") }, true},
+		{"missing key created", func(m *MemoryRepository) { m.Set(ctx, "version:9", "1") }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMemoryRepository()
+			m.Set(ctx, "version:1", "1")
+			m.SAdd(ctx, "parents:2", "plan:1")
+
+			err := m.Watch(ctx, func(watch func(keys ...string) error, tx repositories.RedisTx) error {
+				if err := watch("version:1", "parents:2", "version:9"); err != nil {
+					return err
+				}
+				tx.Set("plan:1", "{}")
+				tt.change(m)
+				return nil
+			})
+
+			_, getErr := m.Get(ctx, "plan:1")
+			if tt.conflict {
+				if err == nil || err.Error() != "TX_CONFLICT" {
+					t.Fatalf("Watch = %v, want TX_CONFLICT", err)
+				}
+				if getErr == nil {
+					t.Error("the conflicting transaction was applied")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Watch: %v", err)
+			}
+			if getErr != nil {
+				t.Errorf("Get(plan:1) after the commit: %v", getErr)
+			}
+		})
+	}
+}
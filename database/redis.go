@@ -1,13 +1,23 @@
 package database
 
 import (
+	"context"
 	"errors"
+	"info7255-bigdata-app/repositories"
+	"log"
+	"strings"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	redis "github.com/redis/go-redis/v9"
 )
 
+const (
+	// scanCount is the COUNT hint of every SCAN call.
+	scanCount = 1000
+	// expiredChannel carries the expired key events of every database.
+	expiredChannel = "__keyevent@*__:expired"
+)
+
 type RedisRepository struct {
 	client redis.Client
 }
@@ -20,12 +30,12 @@ func NewRedisRepository(address string) *RedisRepository {
 	}
 }
 
-func (r *RedisRepository) Ping(ctx *gin.Context) error {
+func (r *RedisRepository) Ping(ctx context.Context) error {
 	_, err := r.client.Ping(ctx).Result()
 	return err
 }
 
-func (r *RedisRepository) Get(ctx *gin.Context, key string) (string, error) {
+func (r *RedisRepository) Get(ctx context.Context, key string) (string, error) {
 	val, err := r.client.Get(ctx, key).Result()
 	if err == redis.Nil {
 		return "", errors.New("KEY_NOT_FOUND")
@@ -33,12 +43,12 @@ func (r *RedisRepository) Get(ctx *gin.Context, key string) (string, error) {
 	return val, err
 }
 
-func (r *RedisRepository) Set(ctx *gin.Context, key, value string) error {
-	_, err := r.client.Set(ctx, key, value, 7*time.Hour).Result()
+func (r *RedisRepository) Set(ctx context.Context, key, value string) error {
+	_, err := r.client.Set(ctx, key, value, 0).Result()
 	return err
 }
 
-func (r *RedisRepository) Delete(ctx *gin.Context, key string) error {
+func (r *RedisRepository) Delete(ctx context.Context, key string) error {
 	res, err := r.client.Del(ctx, key).Result()
 	if res == 0 {
 		return errors.New("KEY_NOT_FOUND")
@@ -46,6 +56,206 @@ func (r *RedisRepository) Delete(ctx *gin.Context, key string) error {
 	return err
 }
 
-func (r *RedisRepository) Keys(ctx *gin.Context, pattern string) ([]string, error) {
-	return r.client.Keys(ctx, pattern).Result()
+// Keys walks the keyspace with SCAN, so a large database is never blocked
+// the way KEYS blocks it.
+func (r *RedisRepository) Keys(ctx context.Context, pattern string) ([]string, error) {
+	keys := make([]string, 0)
+	seen := make(map[string]bool)
+	iter := r.client.Scan(ctx, 0, pattern, scanCount).Iterator()
+	for iter.Next(ctx) {
+		// SCAN may return a key more than once
+		if key := iter.Val(); !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, iter.Err()
+}
+
+func (r *RedisRepository) Incr(ctx context.Context, key string) (int64, error) {
+	return r.client.Incr(ctx, key).Result()
+}
+
+func (r *RedisRepository) SAdd(ctx context.Context, key string, members ...string) error {
+	args := make([]interface{}, len(members))
+	for i, m := range members {
+		args[i] = m
+	}
+	return r.client.SAdd(ctx, key, args...).Err()
+}
+
+func (r *RedisRepository) SMembers(ctx context.Context, key string) ([]string, error) {
+	return r.client.SMembers(ctx, key).Result()
+}
+
+func (r *RedisRepository) LRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	return r.client.LRange(ctx, key, start, stop).Result()
+}
+
+func (r *RedisRepository) ZRangeByLex(ctx context.Context, key, min, max string, count int64) ([]string, error) {
+	return r.client.ZRangeByLex(ctx, key, &redis.ZRangeBy{Min: min, Max: max, Count: count}).Result()
+}
+
+func (r *RedisRepository) ZRevRangeByLex(ctx context.Context, key, max, min string, count int64) ([]string, error) {
+	return r.client.ZRevRangeByLex(ctx, key, &redis.ZRangeBy{Min: min, Max: max, Count: count}).Result()
+}
+
+// SubscribeExpired turns on expired key events, which Redis leaves off by
+// default, and listens for them. Events are not queued: keys that expire
+// while nobody listens are never reported.
+func (r *RedisRepository) SubscribeExpired(ctx context.Context, fn func(key string)) error {
+	if err := r.enableExpiredEvents(ctx); err != nil {
+		// A managed Redis may refuse CONFIG but have the events on already
+		log.Printf("Could not enable expired key events, relying on the server configuration: %v", err)
+	}
+
+	pubsub := r.client.PSubscribe(ctx, expiredChannel)
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-messages:
+			if !ok {
+				return errors.New("expired key subscription closed")
+			}
+			fn(msg.Payload)
+		}
+	}
+}
+
+// enableExpiredEvents adds the E and x flags to notify-keyspace-events,
+// keeping whatever else is configured.
+func (r *RedisRepository) enableExpiredEvents(ctx context.Context) error {
+	config, err := r.client.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		return err
+	}
+	flags := config["notify-keyspace-events"]
+	updated := flags
+	for _, flag := range []string{"E", "x"} {
+		// A includes x
+		if !strings.Contains(updated, flag) && !(flag == "x" && strings.Contains(updated, "A")) {
+			updated += flag
+		}
+	}
+	if updated == flags {
+		return nil
+	}
+	return r.client.ConfigSet(ctx, "notify-keyspace-events", updated).Err()
+}
+
+// Batch runs the queued writes inside MULTI/EXEC.
+func (r *RedisRepository) Batch(ctx context.Context, fn func(tx repositories.RedisTx) error) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		return fn(&redisTx{ctx: ctx, pipe: pipe})
+	})
+	return err
+}
+
+// Watch runs fn inside WATCH ... MULTI/EXEC. The watch callback sends WATCH
+// right away on the connection the transaction runs on, so everything read
+// afterwards is covered.
+func (r *RedisRepository) Watch(ctx context.Context, fn func(watch func(keys ...string) error, tx repositories.RedisTx) error) error {
+	err := r.client.Watch(ctx, func(rtx *redis.Tx) error {
+		watch := func(keys ...string) error {
+			if len(keys) == 0 {
+				return nil
+			}
+			return rtx.Watch(ctx, keys...).Err()
+		}
+		_, err := rtx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return fn(watch, &redisTx{ctx: ctx, pipe: pipe})
+		})
+		return err
+	})
+	if errors.Is(err, redis.TxFailedErr) {
+		return errors.New("TX_CONFLICT")
+	}
+	return err
+}
+
+type redisTx struct {
+	ctx  context.Context
+	pipe redis.Pipeliner
+}
+
+func (t *redisTx) Set(key, value string) {
+	t.pipe.Set(t.ctx, key, value, 0)
+}
+
+func (t *redisTx) SetEx(key, value string, ttl time.Duration) {
+	t.pipe.Set(t.ctx, key, value, ttl)
+}
+
+func (t *redisTx) Persist(key string) {
+	t.pipe.Persist(t.ctx, key)
+}
+
+func (t *redisTx) Delete(keys ...string) {
+	if len(keys) > 0 {
+		t.pipe.Del(t.ctx, keys...)
+	}
+}
+
+func (t *redisTx) SAdd(key string, members ...string) {
+	args := make([]interface{}, len(members))
+	for i, m := range members {
+		args[i] = m
+	}
+	t.pipe.SAdd(t.ctx, key, args...)
+}
+
+func (t *redisTx) SRem(key string, members ...string) {
+	if len(members) == 0 {
+		return
+	}
+	args := make([]interface{}, len(members))
+	for i, m := range members {
+		args[i] = m
+	}
+	t.pipe.SRem(t.ctx, key, args...)
+}
+
+func (t *redisTx) RPush(key string, values ...string) {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	t.pipe.RPush(t.ctx, key, args...)
+}
+
+func (t *redisTx) LRem(key, value string) {
+	t.pipe.LRem(t.ctx, key, 0, value)
+}
+
+func (t *redisTx) LTrim(key string, start, stop int64) {
+	t.pipe.LTrim(t.ctx, key, start, stop)
+}
+
+func (t *redisTx) ZAdd(key string, members ...string) {
+	if len(members) == 0 {
+		return
+	}
+	zs := make([]redis.Z, len(members))
+	for i, m := range members {
+		zs[i] = redis.Z{Member: m}
+	}
+	t.pipe.ZAdd(t.ctx, key, zs...)
+}
+
+func (t *redisTx) ZRem(key string, members ...string) {
+	if len(members) == 0 {
+		return
+	}
+	args := make([]interface{}, len(members))
+	for i, m := range members {
+		args[i] = m
+	}
+	t.pipe.ZRem(t.ctx, key, args...)
 }
@@ -0,0 +1,248 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// MappingVersion is the version of Mapping. Raise it whenever Mapping
+// changes in a way existing indices cannot take, then run the reindex
+// command to move the data.
+const MappingVersion = 2
+
+// VersionedIndex returns the name of the physical index for version.
+func VersionedIndex(version int) string {
+	return IndexName + "_v" + strconv.Itoa(version)
+}
+
+// IndexVersion parses the version out of a physical index name, returning 0
+// when index is not a versioned plans index.
+func IndexVersion(index string) int {
+	suffix, ok := strings.CutPrefix(index, IndexName+"_v")
+	if !ok {
+		return 0
+	}
+	version, err := strconv.Atoi(suffix)
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+// MappingVersionError reports that the index written to was created for an
+// older MappingVersion. Its documents were written the way that version
+// laid them out, so the data has to be moved with the reindex command.
+type MappingVersionError struct {
+	Index   string
+	Version int
+}
+
+func (e *MappingVersionError) Error() string {
+	return fmt.Sprintf("index %s has mapping version %d, below the current %d; run the reindex command to move the data",
+		e.Index, e.Version, MappingVersion)
+}
+
+// checkMappingVersion fails with a *MappingVersionError when index was
+// created for an older MappingVersion.
+func checkMappingVersion(index string) error {
+	if version := IndexVersion(index); version < MappingVersion {
+		return &MappingVersionError{Index: index, Version: version}
+	}
+	return nil
+}
+
+// AliasAction is one entry of an _aliases request.
+type AliasAction map[string]map[string]string
+
+func AddAlias(index, alias string) AliasAction {
+	return AliasAction{"add": {"index": index, "alias": alias}}
+}
+
+func RemoveAlias(index, alias string) AliasAction {
+	return AliasAction{"remove": {"index": index, "alias": alias}}
+}
+
+func RemoveIndex(index string) AliasAction {
+	return AliasAction{"remove_index": {"index": index}}
+}
+
+// UpdateAliases applies actions in one atomic _aliases request.
+func UpdateAliases(es *elasticsearch.Client, actions ...AliasAction) error {
+	body, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+
+	res, err := es.Indices.UpdateAliases(bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error updating aliases: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("error updating aliases: %s", res.String())
+	}
+	return nil
+}
+
+// AliasTarget returns the index alias points to, or "" when the alias does
+// not exist.
+func AliasTarget(es *elasticsearch.Client, alias string) (string, error) {
+	res, err := es.Indices.GetAlias(es.Indices.GetAlias.WithName(alias))
+	if err != nil {
+		return "", fmt.Errorf("error reading alias %s: %w", alias, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if res.IsError() {
+		return "", fmt.Errorf("error reading alias %s: %s", alias, res.String())
+	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("error decoding alias %s: %w", alias, err)
+	}
+	if len(body) != 1 {
+		return "", fmt.Errorf("alias %s points to %d indices, expected 1", alias, len(body))
+	}
+	for index := range body {
+		return index, nil
+	}
+	return "", nil
+}
+
+// CreateIndex creates index with mapping and Settings.
+func CreateIndex(es *elasticsearch.Client, index string, mapping map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"settings": Settings(), "mappings": mapping})
+	if err != nil {
+		return err
+	}
+
+	res, err := es.Indices.Create(index, es.Indices.Create.WithBody(bytes.NewReader(body)))
+	if err != nil {
+		return fmt.Errorf("error creating index %s: %w", index, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("error creating index %s: %s", index, res.String())
+	}
+
+	log.Printf("Index %s created", index)
+	return nil
+}
+
+// EnsureAliases sets up the read and write aliases over a versioned index
+// without losing data, then checks the mapping of the index written to.
+//   - Nothing exists: VersionedIndex(MappingVersion) is created and both
+//     aliases point at it.
+//   - A concrete index named IndexName exists from before aliases were used:
+//     its documents are copied into a versioned index, and the old index is
+//     swapped for the aliases in one atomic step.
+//   - The aliases exist: the write index is checked with EnsureIndex.
+//
+// A write index created for an older MappingVersion fails with a
+// *MappingVersionError instead of being written to.
+func EnsureAliases(es *elasticsearch.Client) error {
+	writeIndex, err := AliasTarget(es, WriteAlias)
+	if err != nil {
+		return err
+	}
+	if writeIndex != "" {
+		if err := checkMappingVersion(writeIndex); err != nil {
+			return err
+		}
+		return EnsureIndex(es, WriteAlias, Mapping())
+	}
+
+	res, err := es.Indices.Exists([]string{IndexName})
+	if err != nil {
+		return fmt.Errorf("error checking index %s: %w", IndexName, err)
+	}
+	res.Body.Close()
+
+	readIndex, err := AliasTarget(es, IndexName)
+	if err != nil {
+		return err
+	}
+
+	index := VersionedIndex(MappingVersion)
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		if err := CreateIndex(es, index, Mapping()); err != nil {
+			return err
+		}
+		return UpdateAliases(es, AddAlias(index, IndexName), AddAlias(index, WriteAlias))
+	case readIndex != "":
+		// Only the write alias went missing
+		log.Printf("Restoring alias %s on %s", WriteAlias, readIndex)
+		if err := UpdateAliases(es, AddAlias(readIndex, WriteAlias)); err != nil {
+			return err
+		}
+		if err := checkMappingVersion(readIndex); err != nil {
+			return err
+		}
+		return EnsureIndex(es, WriteAlias, Mapping())
+	case res.StatusCode == http.StatusOK:
+		log.Printf("Moving the concrete %s index behind aliases", IndexName)
+		if err := CreateIndex(es, index, Mapping()); err != nil {
+			return err
+		}
+		if err := Reindex(es, IndexName, index); err != nil {
+			return err
+		}
+		return UpdateAliases(es,
+			RemoveIndex(IndexName),
+			AddAlias(index, IndexName),
+			AddAlias(index, WriteAlias),
+		)
+	default:
+		return fmt.Errorf("error checking index %s: %s", IndexName, res.String())
+	}
+}
+
+// Reindex copies every document of source into dest with _reindex, keeping
+// their versions. A document live traffic already wrote to dest is only
+// replaced if source holds a higher version of it, and one live traffic
+// deleted from dest within DeleteRetention is not copied back.
+func Reindex(es *elasticsearch.Client, source, dest string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"conflicts": "proceed",
+		"source":    map[string]interface{}{"index": source},
+		"dest":      map[string]interface{}{"index": dest, "version_type": "external"},
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := es.Reindex(bytes.NewReader(body), es.Reindex.WithWaitForCompletion(true))
+	if err != nil {
+		return fmt.Errorf("error reindexing %s into %s: %w", source, dest, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("error reindexing %s into %s: %s", source, dest, res.String())
+	}
+
+	var result struct {
+		Total    int               `json:"total"`
+		Created  int               `json:"created"`
+		Failures []json.RawMessage `json:"failures"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return fmt.Errorf("error decoding the reindex response: %w", err)
+	}
+	if len(result.Failures) > 0 {
+		return fmt.Errorf("reindexing %s into %s failed for %d documents: %s", source, dest, len(result.Failures), result.Failures[0])
+	}
+
+	log.Printf("Reindexed %s into %s: %d of %d documents copied", source, dest, result.Created, result.Total)
+	return nil
+}
@@ -0,0 +1,78 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// BulkCreate writes documents into index with one _bulk request. Documents
+// that already exist are left alone: during a backfill they were written by
+// live traffic and are newer than the copy. A versioned document only
+// replaces an existing one with a lower version.
+func BulkCreate(es *elasticsearch.Client, index string, documents []Document) error {
+	if len(documents) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	for _, document := range documents {
+		op := "create"
+		meta := map[string]interface{}{"_id": document.ID}
+		if document.Routing != "" {
+			meta["routing"] = document.Routing
+		}
+		if document.Version > 0 {
+			op = "index"
+			meta["version"] = document.Version
+			meta["version_type"] = "external"
+		}
+		line, err := json.Marshal(map[string]interface{}{op: meta})
+		if err != nil {
+			return err
+		}
+		source, err := json.Marshal(document.Source)
+		if err != nil {
+			return fmt.Errorf("error serializing document ID=%s: %w", document.ID, err)
+		}
+		body.Write(line)
+		body.WriteByte('\n')
+		body.Write(source)
+		body.WriteByte('\n')
+	}
+
+	res, err := es.Bulk(&body, es.Bulk.WithIndex(index))
+	if err != nil {
+		return fmt.Errorf("error sending bulk request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("bulk request failed: %s", res.String())
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			ID     string          `json:"_id"`
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return fmt.Errorf("error decoding bulk response: %w", err)
+	}
+	if !result.Errors {
+		return nil
+	}
+	for _, item := range result.Items {
+		for _, written := range item {
+			if written.Status >= 300 && written.Status != http.StatusConflict {
+				return fmt.Errorf("error creating document ID=%s: %s", written.ID, written.Error)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package elastic
+
+import "info7255-bigdata-app/graph"
+
+const (
+	// IndexName is the alias searches read plans and their children from.
+	IndexName = "plans"
+	// WriteAlias is the alias the indexer writes to. During a reindex it
+	// already points at the new index while IndexName still serves the old.
+	WriteAlias = "plans_write"
+)
+
+// Document is one Elasticsearch document derived from a stored object.
+type Document struct {
+	// ID is the document id, see DocumentID.
+	ID       string
+	ObjectId string
+	Routing  string
+	Source   map[string]interface{}
+	// Version is the external version to write the document with, 0 to let
+	// Elasticsearch count versions itself.
+	Version int64
+}
+
+// DocumentID returns the id of the document of objectId in the plan routing
+// points to. An object shared by several plans has one document per plan,
+// each joined to its parent there, so children are identified by the plan
+// as well. A plan itself keeps its objectId.
+func DocumentID(objectId, routing string) string {
+	if routing == "" || routing == objectId {
+		return objectId
+	}
+	return routing + "/" + objectId
+}
+
+// Documents flattens a plan graph into one document per identifiable object.
+// Every object keeps its nested content and gets a plan_join field relating
+// it to its parent. Children are routed to the root so the whole graph lives
+// on one shard, which the join field requires.
+func Documents(doc map[string]interface{}) ([]Document, error) {
+	nodes, err := graph.Split(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	documents := make([]Document, 0, len(nodes))
+	for _, node := range nodes {
+		source := make(map[string]interface{}, len(node.Document)+1)
+		for key, value := range node.Document {
+			source[key] = value
+		}
+
+		join := map[string]interface{}{
+			"name": node.Relation,
+		}
+		routing := ""
+		if node.ParentId != "" {
+			routing = node.RootId
+			join["parent"] = DocumentID(node.ParentId, routing)
+		}
+		source["plan_join"] = join
+
+		documents = append(documents, Document{
+			ID:       DocumentID(node.ObjectId, routing),
+			ObjectId: node.ObjectId,
+			Routing:  routing,
+			Source:   source,
+		})
+	}
+	return documents, nil
+}
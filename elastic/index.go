@@ -0,0 +1,174 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// MappingConflictError reports fields whose existing definition differs from
+// the wanted mapping. Elasticsearch cannot change them in place; the data has
+// to be reindexed into a new index.
+type MappingConflictError struct {
+	Index     string
+	Conflicts []string
+}
+
+func (e *MappingConflictError) Error() string {
+	return fmt.Sprintf("index %s has a mapping that conflicts with the expected one: %s",
+		e.Index, strings.Join(e.Conflicts, "; "))
+}
+
+// EnsureIndex makes sure index exists with mapping without ever deleting data.
+// A missing index is created. Fields the existing index lacks are added in
+// place. Fields defined differently fail with a *MappingConflictError.
+// Settings are applied either way.
+func EnsureIndex(es *elasticsearch.Client, index string, mapping map[string]interface{}) error {
+	res, err := es.Indices.Exists([]string{index})
+	if err != nil {
+		return fmt.Errorf("error checking index %s: %w", index, err)
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNotFound:
+		return CreateIndex(es, index, mapping)
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("error checking index %s: %s", index, res.String())
+	}
+
+	if err := putSettings(es, index); err != nil {
+		return err
+	}
+
+	current, err := currentMapping(es, index)
+	if err != nil {
+		return err
+	}
+
+	missing, conflicts := DiffMapping(mapping, current)
+	if len(conflicts) > 0 {
+		return &MappingConflictError{Index: index, Conflicts: conflicts}
+	}
+	if len(missing) == 0 {
+		log.Printf("Index %s is up to date", index)
+		return nil
+	}
+
+	// New fields can be added to an existing index
+	log.Printf("Adding fields %s to index %s", strings.Join(missing, ", "), index)
+	body, err := json.Marshal(mapping)
+	if err != nil {
+		return err
+	}
+	res, err = es.Indices.PutMapping([]string{index}, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error updating the mapping of %s: %w", index, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("error updating the mapping of %s: %s", index, res.String())
+	}
+	return nil
+}
+
+// putSettings applies Settings to the existing index. They are all dynamic.
+func putSettings(es *elasticsearch.Client, index string) error {
+	body, err := json.Marshal(Settings())
+	if err != nil {
+		return err
+	}
+	res, err := es.Indices.PutSettings(bytes.NewReader(body), es.Indices.PutSettings.WithIndex(index))
+	if err != nil {
+		return fmt.Errorf("error updating the settings of %s: %w", index, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("error updating the settings of %s: %s", index, res.String())
+	}
+	return nil
+}
+
+func currentMapping(es *elasticsearch.Client, index string) (map[string]interface{}, error) {
+	res, err := es.Indices.GetMapping(es.Indices.GetMapping.WithIndex(index))
+	if err != nil {
+		return nil, fmt.Errorf("error reading the mapping of %s: %w", index, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("error reading the mapping of %s: %s", index, res.String())
+	}
+
+	// The response is keyed by the concrete index name, which differs from
+	// index when index is an alias.
+	var body map[string]struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("error decoding the mapping of %s: %w", index, err)
+	}
+	for _, entry := range body {
+		return entry.Mappings, nil
+	}
+	return nil, fmt.Errorf("no mapping returned for %s", index)
+}
+
+// DiffMapping compares the wanted mapping with the current one. It returns
+// the dotted paths of fields current lacks and of fields it defines
+// differently. Fields only current has, e.g. ones added by dynamic mapping,
+// are ignored.
+func DiffMapping(want, current map[string]interface{}) (missing, conflicts []string) {
+	want, current = normalize(want), normalize(current)
+
+	var walk func(want, current map[string]interface{}, prefix string)
+	walk = func(want, current map[string]interface{}, prefix string) {
+		wantProps, _ := want["properties"].(map[string]interface{})
+		currentProps, _ := current["properties"].(map[string]interface{})
+
+		for name, wantField := range wantProps {
+			path := prefix + name
+			currentField, ok := currentProps[name].(map[string]interface{})
+			if !ok {
+				missing = append(missing, path)
+				continue
+			}
+
+			wantDef, _ := wantField.(map[string]interface{})
+			for key, value := range wantDef {
+				if key == "properties" {
+					continue
+				}
+				if !reflect.DeepEqual(value, currentField[key]) {
+					conflicts = append(conflicts, fmt.Sprintf("%s.%s is %v, expected %v", path, key, currentField[key], value))
+				}
+			}
+			walk(wantDef, currentField, path+".")
+		}
+	}
+	walk(want, current, "")
+
+	sort.Strings(missing)
+	sort.Strings(conflicts)
+	return missing, conflicts
+}
+
+// normalize round-trips m through JSON so both sides use the same types.
+func normalize(m map[string]interface{}) map[string]interface{} {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return m
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return m
+	}
+	return out
+}
@@ -0,0 +1,158 @@
+package elastic
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// DeleteRetention is how long the plans index remembers the version of a
+// deleted document (index.gc_deletes). Within it a late write carrying a
+// lower version cannot bring the document back, so the indexer does not
+// apply messages older than that.
+const DeleteRetention = 24 * time.Hour
+
+// CheckCommitTime fails for a message committed at committedAt, RFC 3339,
+// that is too old to apply: past DeleteRetention the index may have
+// forgotten a delete that followed it, and the versions could no longer stop
+// it from bringing the documents back. Messages without a commit time pass.
+func CheckCommitTime(committedAt string) error {
+	if committedAt == "" {
+		return nil
+	}
+	committed, err := time.Parse(time.RFC3339Nano, committedAt)
+	if err != nil {
+		return fmt.Errorf("invalid committedAt %q: %w", committedAt, err)
+	}
+	if time.Since(committed) > DeleteRetention {
+		return fmt.Errorf("message committed at %s is older than %s; run the consistency check instead", committedAt, DeleteRetention)
+	}
+	return nil
+}
+
+// Settings returns the dynamic settings of the plans index.
+func Settings() map[string]interface{} {
+	return map[string]interface{}{
+		"index": map[string]interface{}{
+			"gc_deletes": strconv.Itoa(int(DeleteRetention.Seconds())) + "s",
+		},
+	}
+}
+
+// Mapping returns the mapping of the plans index. The plan_join relations
+// mirror the graph produced by Documents.
+func Mapping() map[string]interface{} {
+	return map[string]interface{}{
+		"properties": map[string]interface{}{
+			"plan_join": map[string]interface{}{
+				"type":                  "join",
+				"eager_global_ordinals": true,
+				"relations": map[string]interface{}{
+					"plan":               []string{"planCostShares", "linkedPlanServices"},
+					"linkedPlanServices": []string{"linkedService", "planserviceCostShares"},
+				},
+			},
+			"objectId": map[string]interface{}{
+				"type": "keyword",
+			},
+			"objectType": map[string]interface{}{
+				"type": "keyword",
+			},
+			"_org": map[string]interface{}{
+				"type": "keyword",
+			},
+			"planType": map[string]interface{}{
+				"type": "keyword",
+			},
+			"creationDate": map[string]interface{}{
+				"type":   "date",
+				"format": "MM-dd-yyyy",
+			},
+			// Cost share documents carry these at the top level
+			"copay": map[string]interface{}{
+				"type": "long",
+			},
+			"deductible": map[string]interface{}{
+				"type": "long",
+			},
+			// The name of a linkedService document, mapped the way dynamic
+			// mapping already did
+			"name": map[string]interface{}{
+				"type": "text",
+				"fields": map[string]interface{}{
+					"keyword": map[string]interface{}{
+						"type":         "keyword",
+						"ignore_above": 256,
+					},
+				},
+			},
+			"planCostShares": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"copay": map[string]interface{}{
+						"type": "long",
+					},
+					"deductible": map[string]interface{}{
+						"type": "long",
+					},
+					"objectId": map[string]interface{}{
+						"type": "keyword",
+					},
+					"objectType": map[string]interface{}{
+						"type": "keyword",
+					},
+					"_org": map[string]interface{}{
+						"type": "keyword",
+					},
+				},
+			},
+			"linkedPlanServices": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"objectId": map[string]interface{}{
+						"type": "keyword",
+					},
+					"objectType": map[string]interface{}{
+						"type": "keyword",
+					},
+					"_org": map[string]interface{}{
+						"type": "keyword",
+					},
+					"linkedService": map[string]interface{}{
+						"properties": map[string]interface{}{
+							"name": map[string]interface{}{
+								"type": "text",
+							},
+							"objectId": map[string]interface{}{
+								"type": "keyword",
+							},
+							"objectType": map[string]interface{}{
+								"type": "keyword",
+							},
+							"_org": map[string]interface{}{
+								"type": "keyword",
+							},
+						},
+					},
+					"planserviceCostShares": map[string]interface{}{
+						"properties": map[string]interface{}{
+							"copay": map[string]interface{}{
+								"type": "long",
+							},
+							"deductible": map[string]interface{}{
+								"type": "long",
+							},
+							"objectId": map[string]interface{}{
+								"type": "keyword",
+							},
+							"objectType": map[string]interface{}{
+								"type": "keyword",
+							},
+							"_org": map[string]interface{}{
+								"type": "keyword",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
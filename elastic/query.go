@@ -0,0 +1,336 @@
+package elastic
+
+import (
+	"errors"
+	"fmt"
+	"info7255-bigdata-app/models"
+	"strings"
+)
+
+const (
+	// MaxSearchSize caps the hits one search returns.
+	MaxSearchSize = 1000
+	// MaxInnerHitsSize is the Elasticsearch default cap on inner hits.
+	MaxInnerHitsSize = 100
+	// maxResultWindow is the Elasticsearch default for from + size.
+	maxResultWindow = 10000
+)
+
+// SearchQuery turns a search request into an Elasticsearch search body.
+// Every field is checked against Mapping(), so a typo or a range on a text
+// field is reported instead of silently matching nothing. All errors describe
+// a bad request.
+func SearchQuery(req models.SearchPlanRequest) (map[string]interface{}, error) {
+	clauses := req.SearchClauses
+	if req.Key != "" {
+		clauses.Must = append(append([]models.SearchCondition{}, clauses.Must...), models.SearchCondition{Field: req.Key, Match: req.Value})
+	}
+
+	body := map[string]interface{}{}
+	query, err := boolQuery(clauses, "")
+	if err != nil {
+		return nil, err
+	}
+	body["query"] = query
+
+	if len(req.Sort) > 0 {
+		sorts := make([]interface{}, 0, len(req.Sort))
+		for i, sort := range req.Sort {
+			fieldType, err := mappedType(sort.Field)
+			if err != nil {
+				return nil, fmt.Errorf("sort[%d]: %w", i, err)
+			}
+			if fieldType != "keyword" && fieldType != "long" && fieldType != "date" {
+				return nil, fmt.Errorf("sort[%d]: cannot sort on %s field %s", i, fieldType, sort.Field)
+			}
+			order := strings.ToLower(sort.Order)
+			if order == "" {
+				order = "asc"
+			}
+			if order != "asc" && order != "desc" {
+				return nil, fmt.Errorf("sort[%d]: order must be asc or desc", i)
+			}
+			sorts = append(sorts, map[string]interface{}{
+				sort.Field: map[string]interface{}{
+					"order": order,
+					// Documents without the field, e.g. other object types,
+					// go last either way
+					"missing":       "_last",
+					"unmapped_type": fieldType,
+				},
+			})
+		}
+		body["sort"] = sorts
+	}
+
+	if len(req.Fields) > 0 {
+		for i, field := range req.Fields {
+			if _, err := mappedType(field); err != nil {
+				return nil, fmt.Errorf("fields[%d]: %w", i, err)
+			}
+		}
+		body["_source"] = req.Fields
+	}
+
+	from := 0
+	if req.From != nil {
+		if *req.From < 0 {
+			return nil, errors.New("from must not be negative")
+		}
+		from = *req.From
+		body["from"] = from
+	}
+	if req.Size != nil {
+		if *req.Size < 0 || *req.Size > MaxSearchSize {
+			return nil, fmt.Errorf("size must be between 0 and %d", MaxSearchSize)
+		}
+		if from+*req.Size > maxResultWindow {
+			return nil, fmt.Errorf("from + size must not exceed %d", maxResultWindow)
+		}
+		body["size"] = *req.Size
+	}
+
+	return body, nil
+}
+
+// boolQuery builds the query of clauses; prefix locates them in errors.
+func boolQuery(clauses models.SearchClauses, prefix string) (map[string]interface{}, error) {
+	query := make(map[string]interface{})
+	groups := []struct {
+		name       string
+		conditions []models.SearchCondition
+	}{
+		{"must", clauses.Must},
+		{"should", clauses.Should},
+		{"must_not", clauses.MustNot},
+		{"filter", clauses.Filter},
+	}
+	for _, group := range groups {
+		if len(group.conditions) == 0 {
+			continue
+		}
+		queries := make([]interface{}, 0, len(group.conditions))
+		for i, condition := range group.conditions {
+			at := fmt.Sprintf("%s%s[%d]", prefix, group.name, i)
+			conditionQuery, err := conditionQuery(condition, at)
+			if err != nil {
+				return nil, err
+			}
+			queries = append(queries, conditionQuery)
+		}
+		query[group.name] = queries
+	}
+	if clauses.MinimumShouldMatch != nil {
+		if len(clauses.Should) == 0 {
+			return nil, fmt.Errorf("%sminimumShouldMatch needs should conditions", prefix)
+		}
+		if *clauses.MinimumShouldMatch < 0 || *clauses.MinimumShouldMatch > len(clauses.Should) {
+			return nil, fmt.Errorf("%sminimumShouldMatch must be between 0 and %d", prefix, len(clauses.Should))
+		}
+		query["minimum_should_match"] = *clauses.MinimumShouldMatch
+	}
+
+	if len(query) == 0 {
+		return map[string]interface{}{"match_all": map[string]interface{}{}}, nil
+	}
+	return map[string]interface{}{"bool": query}, nil
+}
+
+func conditionQuery(condition models.SearchCondition, at string) (map[string]interface{}, error) {
+	set := 0
+	for _, present := range []bool{
+		condition.Match != nil,
+		condition.Term != nil,
+		condition.Terms != nil,
+		condition.Range != nil,
+		condition.Exists,
+		condition.HasChild != nil,
+		condition.HasParent != nil,
+	} {
+		if present {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("%s: a condition needs exactly one of match, term, terms, range, exists, hasChild or hasParent", at)
+	}
+
+	if condition.HasChild != nil || condition.HasParent != nil {
+		if condition.Field != "" {
+			return nil, fmt.Errorf("%s: hasChild and hasParent take no field", at)
+		}
+		if condition.HasChild != nil {
+			return joinQuery(*condition.HasChild, true, at+".hasChild.")
+		}
+		return joinQuery(*condition.HasParent, false, at+".hasParent.")
+	}
+
+	fieldType, err := mappedType(condition.Field)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", at, err)
+	}
+	query, err := fieldQuery(condition, fieldType)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", at, err)
+	}
+	return query, nil
+}
+
+// joinQuery builds a has_child or has_parent query.
+func joinQuery(join models.SearchJoin, child bool, prefix string) (map[string]interface{}, error) {
+	parents, children := joinRelations()
+	query := make(map[string]interface{})
+	name := "has_parent"
+	if child {
+		name = "has_child"
+		if !children[join.Type] {
+			return nil, fmt.Errorf("%stype must be a child relation, got %q", prefix, join.Type)
+		}
+		query["type"] = join.Type
+		if join.MinChildren != nil {
+			if *join.MinChildren < 1 {
+				return nil, fmt.Errorf("%sminChildren must be at least 1", prefix)
+			}
+			query["min_children"] = *join.MinChildren
+		}
+		if join.MaxChildren != nil {
+			if *join.MaxChildren < 1 || (join.MinChildren != nil && *join.MaxChildren < *join.MinChildren) {
+				return nil, fmt.Errorf("%smaxChildren must be at least 1 and not below minChildren", prefix)
+			}
+			query["max_children"] = *join.MaxChildren
+		}
+	} else {
+		if !parents[join.Type] {
+			return nil, fmt.Errorf("%stype must be a parent relation, got %q", prefix, join.Type)
+		}
+		if join.MinChildren != nil || join.MaxChildren != nil {
+			return nil, fmt.Errorf("%sminChildren and maxChildren only apply to hasChild", prefix)
+		}
+		query["parent_type"] = join.Type
+	}
+
+	inner, err := boolQuery(join.SearchClauses, prefix)
+	if err != nil {
+		return nil, err
+	}
+	query["query"] = inner
+
+	if join.InnerHits != nil {
+		innerHits := make(map[string]interface{})
+		if join.InnerHits.Name != "" {
+			innerHits["name"] = join.InnerHits.Name
+		}
+		if join.InnerHits.Size != nil {
+			if *join.InnerHits.Size < 0 || *join.InnerHits.Size > MaxInnerHitsSize {
+				return nil, fmt.Errorf("%sinnerHits.size must be between 0 and %d", prefix, MaxInnerHitsSize)
+			}
+			innerHits["size"] = *join.InnerHits.Size
+		}
+		if len(join.InnerHits.Fields) > 0 {
+			for i, field := range join.InnerHits.Fields {
+				if _, err := mappedType(field); err != nil {
+					return nil, fmt.Errorf("%sinnerHits.fields[%d]: %w", prefix, i, err)
+				}
+			}
+			innerHits["_source"] = join.InnerHits.Fields
+		}
+		query["inner_hits"] = innerHits
+	}
+
+	return map[string]interface{}{name: query}, nil
+}
+
+// joinRelations returns the parent and the child relation names of the
+// plan_join field.
+func joinRelations() (parents, children map[string]bool) {
+	parents, children = make(map[string]bool), make(map[string]bool)
+	properties, _ := Mapping()["properties"].(map[string]interface{})
+	join, _ := properties["plan_join"].(map[string]interface{})
+	relations, _ := join["relations"].(map[string]interface{})
+	for parent, names := range relations {
+		parents[parent] = true
+		list, _ := names.([]string)
+		for _, name := range list {
+			children[name] = true
+		}
+	}
+	return parents, children
+}
+
+// fieldQuery builds the query of a condition on a single field.
+func fieldQuery(condition models.SearchCondition, fieldType string) (map[string]interface{}, error) {
+	field := condition.Field
+	switch {
+	case condition.Exists:
+		return map[string]interface{}{"exists": map[string]interface{}{"field": field}}, nil
+
+	case condition.Match != nil:
+		if fieldType == "object" {
+			return nil, fmt.Errorf("cannot match object field %s", field)
+		}
+		return map[string]interface{}{"match": map[string]interface{}{field: condition.Match}}, nil
+
+	case condition.Term != nil, condition.Terms != nil:
+		if fieldType != "keyword" && fieldType != "long" {
+			return nil, fmt.Errorf("term filters need a keyword or number field, %s is %s", field, fieldType)
+		}
+		if condition.Term != nil {
+			return map[string]interface{}{"term": map[string]interface{}{field: condition.Term}}, nil
+		}
+		if len(condition.Terms) == 0 {
+			return nil, fmt.Errorf("terms on %s must not be empty", field)
+		}
+		return map[string]interface{}{"terms": map[string]interface{}{field: condition.Terms}}, nil
+
+	default:
+		if fieldType != "long" && fieldType != "date" {
+			return nil, fmt.Errorf("range filters need a number or date field, %s is %s", field, fieldType)
+		}
+		bounds := make(map[string]interface{})
+		for name, value := range map[string]interface{}{
+			"gt":  condition.Range.Gt,
+			"gte": condition.Range.Gte,
+			"lt":  condition.Range.Lt,
+			"lte": condition.Range.Lte,
+		} {
+			if value != nil {
+				bounds[name] = value
+			}
+		}
+		if len(bounds) == 0 {
+			return nil, fmt.Errorf("range on %s needs at least one bound", field)
+		}
+		return map[string]interface{}{"range": map[string]interface{}{field: bounds}}, nil
+	}
+}
+
+// mappedType returns the type Mapping() gives the dotted path field, or
+// "object" for a field that only groups other fields.
+func mappedType(field string) (string, error) {
+	if field == "" {
+		return "", errors.New("field is required")
+	}
+
+	current := Mapping()
+	for _, name := range strings.Split(field, ".") {
+		properties, _ := current["properties"].(map[string]interface{})
+		next, ok := properties[name].(map[string]interface{})
+		if !ok {
+			// Multi-fields, e.g. name.keyword
+			fields, _ := current["fields"].(map[string]interface{})
+			if next, ok = fields[name].(map[string]interface{}); !ok {
+				return "", fmt.Errorf("unknown field %s", field)
+			}
+		}
+		current = next
+	}
+
+	fieldType, _ := current["type"].(string)
+	switch fieldType {
+	case "":
+		return "object", nil
+	case "join":
+		return "", fmt.Errorf("cannot search the join field %s", field)
+	}
+	return fieldType, nil
+}
@@ -0,0 +1,79 @@
+package elastic
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+const (
+	scanPageSize  = 1000
+	scanKeepAlive = time.Minute
+)
+
+type scanResponse struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []struct {
+			ID      string                 `json:"_id"`
+			Routing string                 `json:"_routing"`
+			Source  map[string]interface{} `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// Scan calls fn for every document in index, in no particular order.
+func Scan(es *elasticsearch.Client, index string, fn func(Document) error) error {
+	res, err := es.Search(
+		es.Search.WithIndex(index),
+		es.Search.WithScroll(scanKeepAlive),
+		es.Search.WithSize(scanPageSize),
+		es.Search.WithSort("_doc"),
+		es.Search.WithBody(strings.NewReader(`{"query":{"match_all":{}}}`)),
+	)
+	if err != nil {
+		return fmt.Errorf("error scanning %s: %w", index, err)
+	}
+
+	scrollID := ""
+	defer func() {
+		if scrollID != "" {
+			if res, err := es.ClearScroll(es.ClearScroll.WithScrollID(scrollID)); err == nil {
+				res.Body.Close()
+			}
+		}
+	}()
+
+	for {
+		if res.IsError() {
+			res.Body.Close()
+			return fmt.Errorf("error scanning %s: %s", index, res.String())
+		}
+
+		var page scanResponse
+		err := json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("error decoding the scan of %s: %w", index, err)
+		}
+		scrollID = page.ScrollID
+
+		if len(page.Hits.Hits) == 0 {
+			return nil
+		}
+		for _, hit := range page.Hits.Hits {
+			objectId, _ := hit.Source["objectId"].(string)
+			if err := fn(Document{ID: hit.ID, ObjectId: objectId, Routing: hit.Routing, Source: hit.Source}); err != nil {
+				return err
+			}
+		}
+
+		res, err = es.Scroll(es.Scroll.WithScrollID(scrollID), es.Scroll.WithScroll(scanKeepAlive))
+		if err != nil {
+			return fmt.Errorf("error scanning %s: %w", index, err)
+		}
+	}
+}
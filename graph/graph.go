@@ -0,0 +1,193 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+)
+
+// RefKey is the property a stored object uses in place of a nested object
+// that lives under its own key.
+const RefKey = "$ref"
+
+// Node is one identifiable object of a document, i.e. any JSON object that
+// carries both objectId and objectType.
+type Node struct {
+	ObjectId   string
+	ObjectType string
+	// ParentId is the nearest identifiable ancestor, empty for the root.
+	ParentId string
+	RootId   string
+	// Relation is the property the object hangs under in its parent. The
+	// root uses its objectType.
+	Relation string
+	// Body is the object with every nested node replaced by a reference.
+	Body map[string]interface{}
+	// Document is the object as it was received, nested nodes included.
+	Document map[string]interface{}
+}
+
+// Identity returns the objectId and objectType of obj when it has both.
+func Identity(obj map[string]interface{}) (string, string, bool) {
+	objectId, _ := obj["objectId"].(string)
+	objectType, _ := obj["objectType"].(string)
+	return objectId, objectType, objectId != "" && objectType != ""
+}
+
+// Ref returns the referenced objectId when v is a reference written by Split.
+func Ref(v interface{}) (string, bool) {
+	obj, ok := v.(map[string]interface{})
+	if !ok || len(obj) != 1 {
+		return "", false
+	}
+	id, ok := obj[RefKey].(string)
+	return id, ok
+}
+
+// Split walks doc and returns every identifiable object in it, root first.
+func Split(doc map[string]interface{}) ([]Node, error) {
+	rootId, rootType, ok := Identity(doc)
+	if !ok {
+		return nil, errors.New("document must have an objectId and an objectType")
+	}
+
+	nodes := make([]Node, 0, 8)
+	seen := make(map[string]bool)
+
+	var visit func(obj map[string]interface{}, parentId, relation string) error
+	visit = func(obj map[string]interface{}, parentId, relation string) error {
+		objectId, objectType, _ := Identity(obj)
+		if seen[objectId] {
+			return fmt.Errorf("objectId %q appears more than once in the document", objectId)
+		}
+		seen[objectId] = true
+
+		index := len(nodes)
+		nodes = append(nodes, Node{
+			ObjectId:   objectId,
+			ObjectType: objectType,
+			ParentId:   parentId,
+			RootId:     rootId,
+			Relation:   relation,
+			Document:   obj,
+		})
+
+		body, err := strip(obj, relation, func(child map[string]interface{}, childRelation string) error {
+			return visit(child, objectId, childRelation)
+		})
+		if err != nil {
+			return err
+		}
+		nodes[index].Body = body.(map[string]interface{})
+		return nil
+	}
+
+	if err := visit(doc, "", rootType); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// strip copies value, replacing every nested identifiable object with a
+// reference and handing it to onNode.
+func strip(value interface{}, relation string, onNode func(map[string]interface{}, string) error) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			if obj, ok := child.(map[string]interface{}); ok {
+				if childId, _, ok := Identity(obj); ok {
+					if err := onNode(obj, key); err != nil {
+						return nil, err
+					}
+					out[key] = map[string]interface{}{RefKey: childId}
+					continue
+				}
+			}
+			stripped, err := strip(child, key, onNode)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = stripped
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			if obj, ok := item.(map[string]interface{}); ok {
+				if childId, _, ok := Identity(obj); ok {
+					if err := onNode(obj, relation); err != nil {
+						return nil, err
+					}
+					out[i] = map[string]interface{}{RefKey: childId}
+					continue
+				}
+			}
+			stripped, err := strip(item, relation, onNode)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = stripped
+		}
+		return out, nil
+	default:
+		return value, nil
+	}
+}
+
+// Assemble rebuilds the document rooted at objectId, loading every
+// referenced object through load.
+func Assemble(objectId string, load func(objectId string) (map[string]interface{}, error)) (map[string]interface{}, error) {
+	visiting := make(map[string]bool)
+
+	var build func(id string) (map[string]interface{}, error)
+	build = func(id string) (map[string]interface{}, error) {
+		if visiting[id] {
+			return nil, fmt.Errorf("reference cycle at objectId %q", id)
+		}
+		visiting[id] = true
+		defer delete(visiting, id)
+
+		body, err := load(id)
+		if err != nil {
+			return nil, err
+		}
+		resolved, err := resolve(body, build)
+		if err != nil {
+			return nil, err
+		}
+		return resolved.(map[string]interface{}), nil
+	}
+
+	return build(objectId)
+}
+
+func resolve(value interface{}, build func(string) (map[string]interface{}, error)) (interface{}, error) {
+	if id, ok := Ref(value); ok {
+		return build(id)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			resolved, err := resolve(child, build)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = resolved
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			resolved, err := resolve(item, build)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = resolved
+		}
+		return out, nil
+	default:
+		return value, nil
+	}
+}
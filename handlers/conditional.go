@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// representation describes the current state of a resource for evaluating
+// the preconditions of a request against it (RFC 9110 section 13).
+type representation struct {
+	exists bool
+	// etag is the quoted strong entity-tag of the stored bytes.
+	etag string
+	// modified is zero when the last modification date is unknown.
+	modified time.Time
+	// versions are the stored versions of the objects the representation
+	// was assembled from, by objectId.
+	versions map[string]int64
+}
+
+// entityTag is one member of an If-Match or If-None-Match list.
+type entityTag struct {
+	weak   bool
+	opaque string
+}
+
+// strongETag returns the entity-tag of a representation's bytes.
+func strongETag(body []byte) string {
+	return `"` + generateSHA1Hash(body) + `"`
+}
+
+// parseETags parses an If-Match or If-None-Match value, which is either "*"
+// or a comma separated list of entity-tags. Unquoted values, as sent by
+// clients of earlier versions of the API, are taken as strong tags.
+func parseETags(value string) (tags []entityTag, any bool) {
+	value = strings.TrimSpace(value)
+	if value == "*" {
+		return nil, true
+	}
+
+	for value != "" {
+		value = strings.TrimLeft(value, ", \t")
+		if value == "" {
+			break
+		}
+
+		var tag entityTag
+		if strings.HasPrefix(value, "W/") {
+			tag.weak = true
+			value = value[2:]
+		}
+		if strings.HasPrefix(value, `"`) {
+			end := strings.IndexByte(value[1:], '"')
+			if end < 0 {
+				// An unterminated tag cannot match anything
+				return tags, false
+			}
+			tag.opaque = value[1 : end+1]
+			value = value[end+2:]
+		} else {
+			end := strings.IndexAny(value, ", \t")
+			if end < 0 {
+				end = len(value)
+			}
+			tag.opaque = value[:end]
+			value = value[end:]
+		}
+		tags = append(tags, tag)
+	}
+	return tags, false
+}
+
+// matchETag compares etag against the header value. Strong comparison
+// requires both tags to be strong, weak comparison only looks at the
+// opaque tags.
+func matchETag(header, etag string, weak bool) bool {
+	current := strings.Trim(etag, `"`)
+	tags, _ := parseETags(header)
+	for _, tag := range tags {
+		if tag.opaque == current && (weak || !tag.weak) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions evaluates the conditional headers of the request in the
+// order of RFC 9110 section 13.2.2. It returns the status to answer with
+// instead of performing the request, or 0 to go ahead.
+func checkPreconditions(c *gin.Context, rep representation) int {
+	safe := c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead
+
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" {
+		if !ifMatchHolds(ifMatch, rep) {
+			return http.StatusPreconditionFailed
+		}
+	} else if since, ok := headerTime(c, "If-Unmodified-Since"); ok && rep.exists && !rep.modified.IsZero() {
+		if rep.modified.Truncate(time.Second).After(since) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" {
+		if ifNoneMatchFails(ifNoneMatch, rep) {
+			if safe {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if since, ok := headerTime(c, "If-Modified-Since"); ok && safe && rep.exists && !rep.modified.IsZero() {
+		if !rep.modified.Truncate(time.Second).After(since) {
+			return http.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+func ifMatchHolds(header string, rep representation) bool {
+	if !rep.exists {
+		return false
+	}
+	if _, any := parseETags(header); any {
+		return true
+	}
+	return matchETag(header, rep.etag, false)
+}
+
+func ifNoneMatchFails(header string, rep representation) bool {
+	if !rep.exists {
+		return false
+	}
+	if _, any := parseETags(header); any {
+		return true
+	}
+	return matchETag(header, rep.etag, true)
+}
+
+// headerTime parses an HTTP-date header. Invalid dates are ignored, as RFC
+// 9110 requires.
+func headerTime(c *gin.Context, name string) (time.Time, bool) {
+	value := c.GetHeader(name)
+	if value == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// setValidators sends the ETag and Last-Modified of rep.
+func setValidators(c *gin.Context, rep representation) {
+	if !rep.exists {
+		return
+	}
+	c.Header("ETag", rep.etag)
+	if !rep.modified.IsZero() {
+		c.Header("Last-Modified", rep.modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+func generateSHA1Hash(data []byte) string {
+	h := sha1.New()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"info7255-bigdata-app/services"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ConsistencyHandler struct {
+	service services.ConsistencyService
+}
+
+func NewConsistencyHandler(service services.ConsistencyService) *ConsistencyHandler {
+	return &ConsistencyHandler{
+		service: service,
+	}
+}
+
+func (ch *ConsistencyHandler) CheckConsistency(c *gin.Context) {
+	ch.check(c, false)
+}
+
+func (ch *ConsistencyHandler) RepairConsistency(c *gin.Context) {
+	ch.check(c, true)
+}
+
+func (ch *ConsistencyHandler) check(c *gin.Context, repair bool) {
+	report, err := ch.service.Check(c, repair)
+	if err != nil {
+		log.Printf("Failed to check consistency with err : %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
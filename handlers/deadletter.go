@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"encoding/json"
+	"info7255-bigdata-app/elastic"
+	"info7255-bigdata-app/models"
+	"info7255-bigdata-app/rabbitmq"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxDeadLetterLimit = 1000
+
+type DeadLetterHandler struct {
+	deadLetters rabbitmq.DeadLetters
+}
+
+func NewDeadLetterHandler(deadLetters rabbitmq.DeadLetters) *DeadLetterHandler {
+	return &DeadLetterHandler{
+		deadLetters: deadLetters,
+	}
+}
+
+func (dh *DeadLetterHandler) ListDeadLetters(c *gin.Context) {
+	limit, ok := deadLetterLimit(c, 20)
+	if !ok {
+		return
+	}
+
+	parked, ok := parkedQueue(c)
+	if !ok {
+		return
+	}
+
+	letters, err := dh.deadLetters.Peek(rabbitmq.PlansQueue, parked, limit)
+	if err != nil {
+		log.Printf("Failed to read dead letters with err : %v", err.Error())
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Message broker unavailable"})
+		return
+	}
+
+	c.JSON(http.StatusOK, letters)
+}
+
+func (dh *DeadLetterHandler) ReplayDeadLetters(c *gin.Context) {
+	limit, ok := deadLetterLimit(c, 100)
+	if !ok {
+		return
+	}
+
+	parked, ok := parkedQueue(c)
+	if !ok {
+		return
+	}
+
+	result, err := dh.deadLetters.Replay(rabbitmq.PlansQueue, parked, limit, replayable)
+	if err != nil {
+		log.Printf("Failed to replay dead letters after %d with err : %v", result.Replayed, err.Error())
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Message broker unavailable", "replayed": result.Replayed, "rejected": result.Rejected})
+		return
+	}
+	if result.Rejected > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":    "Some messages are too old to apply and were quarantined; run the consistency check to index their plans",
+			"replayed": result.Replayed,
+			"rejected": result.Rejected,
+			"reasons":  result.Reasons,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// replayable rejects plan messages the consumer would no longer apply. A
+// body that does not decode is replayed, and quarantined by the consumer.
+func replayable(body []byte) error {
+	var message models.PlanMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		return nil
+	}
+	return elastic.CheckCommitTime(message.CommittedAt)
+}
+
+func deadLetterLimit(c *gin.Context, fallback int) (int, bool) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(fallback)))
+	if err != nil || limit < 1 || limit > maxDeadLetterLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxDeadLetterLimit)})
+		return 0, false
+	}
+	return limit, true
+}
+
+// parkedQueue picks the dead-letter queue, or the quarantine queue with
+// ?queue=quarantine.
+func parkedQueue(c *gin.Context) (string, bool) {
+	switch c.DefaultQuery("queue", "dead") {
+	case "dead":
+		return rabbitmq.DeadLetterQueueName(rabbitmq.PlansQueue), true
+	case "quarantine":
+		return rabbitmq.QuarantineQueueName(rabbitmq.PlansQueue), true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "queue must be dead or quarantine"})
+		return "", false
+	}
+}
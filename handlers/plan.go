@@ -3,31 +3,40 @@ package handlers
 import (
 	"bytes"
 	"context"
-	"crypto/sha1"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"info7255-bigdata-app/elastic"
+	"info7255-bigdata-app/graph"
 	"info7255-bigdata-app/models"
+	"info7255-bigdata-app/patch"
+	"info7255-bigdata-app/schema"
 	"info7255-bigdata-app/services"
 	"log"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/elastic/go-elasticsearch/v8/esapi"
 	"github.com/gin-gonic/gin"
-	"github.com/gin-gonic/gin/binding"
 )
 
 type PlanHandler struct {
 	service   services.PlanService
+	schemas   services.SchemaService
 	esFactory *elastic.Factory
+	// requireIfMatch makes PUT, PATCH and DELETE fail with 428 without an
+	// If-Match header.
+	requireIfMatch bool
 }
 
-func NewPlanHandler(service services.PlanService, esFactory *elastic.Factory) *PlanHandler {
+func NewPlanHandler(service services.PlanService, schemas services.SchemaService, esFactory *elastic.Factory, requireIfMatch bool) *PlanHandler {
 	return &PlanHandler{
-		service:   service,
-		esFactory: esFactory,
+		service:        service,
+		schemas:        schemas,
+		esFactory:      esFactory,
+		requireIfMatch: requireIfMatch,
 	}
 }
 
@@ -38,57 +47,62 @@ func (ph *PlanHandler) GetPlan(c *gin.Context) {
 		return
 	}
 
-	plan, err := ph.service.GetAnyObject(c, objectId)
+	body, rep, err := ph.current(c, objectId)
 	if err != nil {
 		log.Printf("Failed to fetch plan with err : %v", err.Error())
-		if err.Error() == "KEY_NOT_FOUND" {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
-		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		return
 	}
-
-	currentETag := generateETag(plan)
-	clientETag := strings.TrimSpace(c.GetHeader("If-None-Match"))
-	if clientETag != "" && clientETag == currentETag {
-		c.Status(http.StatusNotModified)
+	if !rep.exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
 		return
 	}
 
-	clientETag = strings.TrimSpace(c.GetHeader("If-Match"))
-	if clientETag != "" && clientETag != currentETag {
-		c.Status(http.StatusPreconditionFailed)
+	setValidators(c, rep)
+	if status := checkPreconditions(c, rep); status != 0 {
+		c.Status(status)
 		return
 	}
 
-	c.Header("ETag", currentETag)
-	c.JSON(http.StatusOK, plan)
+	// Send the exact bytes the ETag was computed over
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
 }
 
 func (ph *PlanHandler) CreatePlan(c *gin.Context) {
-	var planRequest models.Plan
-
-	if err := c.ShouldBindBodyWith(&planRequest, binding.JSON); err != nil {
-		log.Printf("Bad request with error : %v", err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing or invalid fields in the request"})
+	opts, ok := writeOptions(c)
+	if !ok {
+		return
+	}
+	doc, ok := ph.bindPlan(c, false)
+	if !ok {
 		return
 	}
+	objectId, _, _ := graph.Identity(doc)
 
-	existingPlan, err := ph.service.GetPlan(c, planRequest.ObjectId)
-	if err == nil && existingPlan.ObjectId != "" {
+	_, rep, err := ph.current(c, objectId)
+	if err != nil {
+		log.Printf("Failed to fetch plan with err : %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	if rep.exists {
 		c.JSON(http.StatusConflict, gin.H{"error": "Plan already exists"})
 		return
 	}
 
-	if err := ph.service.CreatePlan(c, planRequest); err != nil {
+	// Only create the plan if nobody else did in the meantime
+	opts.IfVersions = rep.versions
+	if err := ph.service.CreatePlan(c, doc, opts); err != nil {
 		log.Printf("Failed to create plan with error : %v", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create plan"})
+		if err.Error() == "VERSION_CONFLICT" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Plan already exists"})
+		} else if !writeValidationError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create plan"})
+		}
 		return
 	}
 
-	eTag := generateETag(planRequest)
-	c.Header("ETag", eTag)
+	ph.setCurrentValidators(c, objectId)
 	c.JSON(http.StatusCreated, gin.H{"message": "Plan created successfully"})
 }
 
@@ -99,27 +113,31 @@ func (ph *PlanHandler) DeletePlan(c *gin.Context) {
 		return
 	}
 
-	existingPlan, err := ph.service.GetPlan(c, objectId)
+	_, rep, err := ph.current(c, objectId)
 	if err != nil {
 		log.Printf("Failed to delete plan with err : %v", err.Error())
-		if err.Error() == "KEY_NOT_FOUND" {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
-		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		return
 	}
-
-	existingETag := generateETag(existingPlan)
-	clientETag := strings.TrimSpace(c.GetHeader("If-Match"))
-	if clientETag != "" && clientETag != existingETag {
-		c.Status(http.StatusPreconditionFailed)
+	if !ph.requirePrecondition(c) {
+		return
+	}
+	if status := checkPreconditions(c, rep); status != 0 {
+		c.Status(status)
+		return
+	}
+	if !rep.exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
 		return
 	}
 
-	if err := ph.service.DeletePlan(c, objectId); err != nil {
+	var opts models.WriteOptions
+	pinVersion(c, &opts, rep)
+	if err := ph.service.DeletePlan(c, objectId, opts); err != nil {
 		log.Printf("Failed to delete plan with err : %v", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		if !writeConflict(c, err, opts) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		}
 		return
 	}
 
@@ -127,54 +145,59 @@ func (ph *PlanHandler) DeletePlan(c *gin.Context) {
 }
 
 func (ph *PlanHandler) UpdatePlan(c *gin.Context) {
-	var planRequest models.Plan
+	opts, ok := writeOptions(c)
+	if !ok {
+		return
+	}
+	doc, ok := ph.bindPlan(c, false)
+	if !ok {
+		return
+	}
+	objectId, _, _ := graph.Identity(doc)
 
-	if err := c.ShouldBindBodyWith(&planRequest, binding.JSON); err != nil {
-		log.Printf("Bad request with error : %v", err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing or invalid fields in the request"})
+	_, rep, err := ph.current(c, objectId)
+	if err != nil {
+		log.Printf("Failed to fetch plan with err : %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	if !ph.requirePrecondition(c) {
 		return
 	}
+	if status := checkPreconditions(c, rep); status != 0 {
+		c.Status(status)
+		return
+	}
+	pinVersion(c, &opts, rep)
 
-	existingPlan, err := ph.service.GetPlan(c, planRequest.ObjectId)
-	if err != nil || existingPlan.ObjectId == "" {
+	if !rep.exists {
 		// If the plan does not exist, create a new one
-		if err := ph.service.CreatePlan(c, planRequest); err != nil {
+		if err := ph.service.CreatePlan(c, doc, opts); err != nil {
 			log.Printf("Failed to create plan with error : %v", err.Error())
-
-			eTag := generateETag(planRequest)
-			c.Header("ETag", eTag)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create plan"})
+			if writeConflict(c, err, opts) {
+				return
+			}
+			if !writeValidationError(c, err) {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create plan"})
+			}
 			return
 		}
 
+		ph.setCurrentValidators(c, objectId)
 		c.JSON(http.StatusCreated, gin.H{"message": "Plan created successfully"})
 		return
 	}
 
-	currentETag := generateETag(planRequest)
-	existingETag := generateETag(existingPlan)
-
-	clientETag := strings.TrimSpace(c.GetHeader("If-None-Match"))
-	if clientETag != "" && clientETag == currentETag {
-		c.Status(http.StatusNotModified)
-		return
-	}
-
-	clientETag = strings.TrimSpace(c.GetHeader("If-Match"))
-	if clientETag != "" && clientETag != existingETag {
-		c.Status(http.StatusPreconditionFailed)
-		return
-	}
-
-	err = ph.service.UpdatePlan(c, planRequest.ObjectId, planRequest)
+	err = ph.service.UpdatePlan(c, objectId, doc, opts)
 	if err != nil {
 		log.Printf("Failed to update plan with error : %v", err.Error())
-		c.AbortWithStatus(http.StatusInternalServerError)
+		if !writeConflict(c, err, opts) && !writeValidationError(c, err) {
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
 		return
 	}
 
-	eTag := generateETag(planRequest)
-	c.Header("ETag", eTag)
+	ph.setCurrentValidators(c, objectId)
 	c.JSON(http.StatusOK, gin.H{"message": "Plan updated successfully"})
 }
 
@@ -185,64 +208,191 @@ func (ph *PlanHandler) PatchPlan(c *gin.Context) {
 		return
 	}
 
-	var planRequest models.Plan
-	if err := c.ShouldBindBodyWith(&planRequest, binding.JSON); err != nil {
-		log.Printf("Bad request with error : %v", err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing or invalid fields in the request"})
+	opts, ok := writeOptions(c)
+	if !ok {
+		return
+	}
+	planPatch, ok := ph.bindPatch(c)
+	if !ok {
 		return
 	}
 
-	existingPlan, err := ph.service.GetPlan(c, objectId)
-	if err != nil || existingPlan.ObjectId == "" {
+	_, rep, err := ph.current(c, objectId)
+	if err != nil {
 		log.Printf("Failed to fetch plan with err : %v", err.Error())
-		if err.Error() == "KEY_NOT_FOUND" {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	if !ph.requirePrecondition(c) {
+		return
+	}
+	if status := checkPreconditions(c, rep); status != 0 {
+		c.Status(status)
+		return
+	}
+	if !rep.exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+	pinVersion(c, &opts, rep)
+
+	if _, err := ph.service.PatchPlan(c, objectId, planPatch, opts); err != nil {
+		log.Printf("Failed to update plan with error : %v", err.Error())
+		if strings.HasPrefix(err.Error(), "ObjectId mismatch") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else if !writePatchError(c, err) && !writeConflict(c, err, opts) && !writeValidationError(c, err) {
+			c.AbortWithStatus(http.StatusInternalServerError)
 		}
 		return
 	}
 
-	currentETag := generateETag(planRequest)
-	existingETag := generateETag(existingPlan)
+	ph.setCurrentValidators(c, objectId)
+	c.JSON(http.StatusOK, gin.H{"message": "Plan updated successfully"})
+}
 
-	clientETag := strings.TrimSpace(c.GetHeader("If-None-Match"))
-	if clientETag != "" && clientETag == currentETag {
-		c.Status(http.StatusNotModified)
-		return
+// current loads objectId as GET would serve it and describes it for
+// precondition checks. A missing object is not an error, it yields a
+// representation that does not exist.
+func (ph *PlanHandler) current(c *gin.Context, objectId string) ([]byte, representation, error) {
+	// The versions match the document, so a write pinned to them fails
+	// rather than overwriting something the preconditions were not
+	// checked against
+	doc, versions, err := ph.service.GetVersioned(c, objectId)
+	if err != nil {
+		if err.Error() == "KEY_NOT_FOUND" {
+			return nil, representation{versions: versions}, nil
+		}
+		return nil, representation{}, err
 	}
 
-	clientETag = strings.TrimSpace(c.GetHeader("If-Match"))
-	if clientETag != "" && clientETag != existingETag {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return nil, representation{}, err
+	}
+	modified, err := ph.service.LastModified(c, doc)
+	if err != nil {
+		return nil, representation{}, err
+	}
+	return body, representation{exists: true, etag: strongETag(body), modified: modified, versions: versions}, nil
+}
+
+// pinVersion makes a conditional write apply only to the versions its
+// preconditions were evaluated against. Unconditional writes are retried
+// against concurrent writes instead.
+func pinVersion(c *gin.Context, opts *models.WriteOptions, rep representation) {
+	if c.GetHeader("If-Match") != "" || c.GetHeader("If-None-Match") != "" || c.GetHeader("If-Unmodified-Since") != "" {
+		opts.IfVersions = rep.versions
+	}
+}
+
+// writeConflict answers a write that lost against a concurrent one, and
+// reports whether err was such a conflict. A pinned write answers 412, as
+// its preconditions no longer hold; anything else answers 409.
+func writeConflict(c *gin.Context, err error, opts models.WriteOptions) bool {
+	if err.Error() != "VERSION_CONFLICT" {
+		return false
+	}
+	if opts.IfVersions != nil {
 		c.Status(http.StatusPreconditionFailed)
+		return true
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": "The plan was changed concurrently, retry the request"})
+	return true
+}
+
+// setCurrentValidators sends the validators of objectId after a write. They
+// are computed from what was stored, so they match a following GET.
+func (ph *PlanHandler) setCurrentValidators(c *gin.Context, objectId string) {
+	_, rep, err := ph.current(c, objectId)
+	if err != nil {
+		log.Printf("Failed to fetch plan %s after the write with err : %v", objectId, err.Error())
 		return
 	}
+	setValidators(c, rep)
+}
+
+// requirePrecondition answers 428 when If-Match is required and missing. A
+// PUT can send "If-None-Match: *" instead, which only creates the plan since
+// there is no ETag to match yet. It reports whether the handler should go on.
+func (ph *PlanHandler) requirePrecondition(c *gin.Context) bool {
+	if !ph.requireIfMatch || c.GetHeader("If-Match") != "" {
+		return true
+	}
+	if c.Request.Method == http.MethodPut && strings.TrimSpace(c.GetHeader("If-None-Match")) == "*" {
+		return true
+	}
+
+	c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match is required"})
+	return false
+}
 
-	patchedPlan, err := ph.service.PatchPlan(c, objectId, planRequest)
+// GetReferencingPlans answers which plans contain an object, e.g. a
+// linkedService shared by several plans.
+func (ph *PlanHandler) GetReferencingPlans(c *gin.Context) {
+	objectId := c.Param("objectId")
+
+	plans, err := ph.service.ReferencingPlans(c, objectId)
 	if err != nil {
-		log.Printf("Failed to update plan with error : %v", err.Error())
-		if strings.HasPrefix(err.Error(), "ObjectId mismatch") {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		log.Printf("Failed to find the plans referencing %s with err : %v", objectId, err.Error())
+		if err.Error() == "KEY_NOT_FOUND" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Object not found"})
 		} else {
-			c.AbortWithStatus(http.StatusInternalServerError)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		}
 		return
 	}
 
-	eTag := generateETag(patchedPlan)
-	c.Header("ETag", eTag)
-	c.JSON(http.StatusOK, gin.H{"message": "Plan updated successfully"})
+	c.JSON(http.StatusOK, gin.H{"objectId": objectId, "plans": plans})
 }
 
+const (
+	defaultPlanPageSize = 20
+	maxPlanPageSize     = 100
+)
+
+// GetAllPlans lists stored objects a page at a time. Query parameters:
+// limit, cursor, sort (objectId or creationDate), order (asc or desc),
+// objectType (plan by default) and _org.
 func (ph *PlanHandler) GetAllPlans(c *gin.Context) {
-	plans, err := ph.service.GetAllPlans(c)
+	query := models.PlanListQuery{
+		ObjectType: c.DefaultQuery("objectType", "plan"),
+		Org:        c.Query("_org"),
+		Sort:       c.DefaultQuery("sort", "objectId"),
+		Order:      c.DefaultQuery("order", "asc"),
+		Cursor:     c.Query("cursor"),
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultPlanPageSize)))
+	if err != nil || limit < 1 || limit > maxPlanPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxPlanPageSize)})
+		return
+	}
+	query.Limit = limit
+	if query.Sort != "objectId" && query.Sort != "creationDate" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be objectId or creationDate"})
+		return
+	}
+	if query.Order != "asc" && query.Order != "desc" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order must be asc or desc"})
+		return
+	}
+	if query.ObjectType == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "objectType must not be empty"})
+		return
+	}
+
+	page, err := ph.service.ListPlans(c, query)
 	if err != nil {
-		log.Printf("Failed to fetch all plans with err : %v", err.Error())
+		if err.Error() == "INVALID_CURSOR" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cursor does not belong to this query"})
+			return
+		}
+		log.Printf("Failed to list plans with err : %v", err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		return
 	}
 
-	c.JSON(http.StatusOK, plans)
+	c.JSON(http.StatusOK, page)
 }
 
 func (ph *PlanHandler) SearchPlans(c *gin.Context) {
@@ -252,15 +402,12 @@ func (ph *PlanHandler) SearchPlans(c *gin.Context) {
 		return
 	}
 
-	// Create a match query
-	matchQuery := map[string]interface{}{
-		"query": map[string]interface{}{
-			"match": map[string]interface{}{
-				req.Key: req.Value,
-			},
-		},
+	query, err := elastic.SearchQuery(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	queryBytes, err := json.Marshal(matchQuery)
+	queryBytes, err := json.Marshal(query)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -268,7 +415,7 @@ func (ph *PlanHandler) SearchPlans(c *gin.Context) {
 
 	// Create a new search request
 	searchReq := esapi.SearchRequest{
-		Index: []string{"plans"},
+		Index: []string{elastic.IndexName},
 		Body:  bytes.NewReader(queryBytes),
 	}
 
@@ -293,7 +440,12 @@ func (ph *PlanHandler) SearchPlans(c *gin.Context) {
 	defer res.Body.Close()
 
 	if res.IsError() {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": res.String()})
+		// e.g. a date bound that does not parse
+		status := http.StatusInternalServerError
+		if res.StatusCode == http.StatusBadRequest {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": res.String()})
 		return
 	}
 
@@ -306,17 +458,150 @@ func (ph *PlanHandler) SearchPlans(c *gin.Context) {
 	c.JSON(http.StatusOK, result)
 }
 
-func generateETag(plan interface{}) string {
-	dataBytes, err := json.Marshal(plan)
+// bindPlan validates the raw request body against the active plan schema.
+// Partial bodies (PATCH) skip the top-level required list. The schema is
+// the only check, so a schema version can relax what a plan needs. A full
+// plan must still identify itself to be stored. It returns the body as a
+// generic document, which is what gets stored, and writes the error
+// response itself when the handler should stop.
+func (ph *PlanHandler) bindPlan(c *gin.Context, partial bool) (map[string]interface{}, bool) {
+	body, err := c.GetRawData()
+	if err != nil {
+		log.Printf("Failed to read request body with error : %v", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to read the request body"})
+		return nil, false
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(body, &doc); err != nil || doc == nil {
+		log.Printf("Bad request with error : %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body must be a JSON object"})
+		return nil, false
+	}
+
+	if partial {
+		_, err = ph.schemas.Validate(c, "plan", doc, true)
+	} else {
+		_, err = ph.schemas.ValidateDocument(c, doc)
+	}
 	if err != nil {
-		log.Printf("Error marshalling plan: %v", err)
-		return ""
+		if !writeValidationError(c, err) {
+			log.Printf("Failed to validate request body with error : %v", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		}
+		return nil, false
+	}
+
+	if _, _, ok := graph.Identity(doc); !partial && !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A plan needs a string objectId and objectType"})
+		return nil, false
 	}
-	return generateSHA1Hash(dataBytes)
+
+	return doc, true
 }
 
-func generateSHA1Hash(data []byte) string {
-	h := sha1.New()
-	h.Write(data)
-	return hex.EncodeToString(h.Sum(nil))
+// bindPatch reads a PATCH body in the format its Content-Type names:
+// application/json is a partial plan validated against the plan schema,
+// application/merge-patch+json a JSON Merge Patch and
+// application/json-patch+json a JSON Patch. The patched plan is validated
+// as a whole once it is applied. It writes the error response itself when
+// the handler should stop.
+func (ph *PlanHandler) bindPatch(c *gin.Context) (services.Patch, bool) {
+	mediaType := "application/json"
+	if value := c.GetHeader("Content-Type"); value != "" {
+		parsed, _, err := mime.ParseMediaType(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Content-Type"})
+			return nil, false
+		}
+		mediaType = parsed
+	}
+
+	switch mediaType {
+	case "application/json":
+		doc, ok := ph.bindPlan(c, true)
+		return services.PartialPlan(doc), ok
+	case patch.MergePatchType:
+		body, err := c.GetRawData()
+		if err != nil {
+			log.Printf("Failed to read request body with error : %v", err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to read the request body"})
+			return nil, false
+		}
+		// A merge patch that is not an object would replace the whole plan
+		var doc map[string]interface{}
+		if err := json.Unmarshal(body, &doc); err != nil || doc == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Merge patch must be a JSON object"})
+			return nil, false
+		}
+		return services.MergePatch(doc), true
+	case patch.JSONPatchType:
+		body, err := c.GetRawData()
+		if err != nil {
+			log.Printf("Failed to read request body with error : %v", err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to read the request body"})
+			return nil, false
+		}
+		ops, err := patch.ParseOperations(body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return nil, false
+		}
+		return services.JSONPatch(ops), true
+	default:
+		c.Header("Accept-Patch", "application/json, "+patch.MergePatchType+", "+patch.JSONPatchType)
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported patch format " + mediaType})
+		return nil, false
+	}
+}
+
+// writePatchError answers a patch that could not be applied to the stored
+// plan, and reports whether err was one: 409 for a failed test operation,
+// 422 for an operation that does not fit the plan (RFC 5789 section 2.2).
+func writePatchError(c *gin.Context, err error) bool {
+	var patchErr *patch.Error
+	if !errors.As(err, &patchErr) {
+		return false
+	}
+
+	status := http.StatusUnprocessableEntity
+	switch patchErr.Kind {
+	case patch.TestFailed:
+		status = http.StatusConflict
+	case patch.Invalid:
+		status = http.StatusBadRequest
+	}
+	c.JSON(status, gin.H{"error": patchErr.Error()})
+	return true
+}
+
+// writeOptions reads the per-request write settings. X-Retention sets how
+// long the plan is kept, e.g. "720h" or "30d", or "none" to keep it forever.
+// It writes the error response itself when the handler should stop.
+func writeOptions(c *gin.Context) (models.WriteOptions, bool) {
+	var opts models.WriteOptions
+	if value := c.GetHeader("X-Retention"); value != "" {
+		retention, err := services.ParseRetention(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "X-Retention: " + err.Error()})
+			return opts, false
+		}
+		opts.Retention = &retention
+	}
+	return opts, true
+}
+
+// writeValidationError answers with 400 and the violation list when err comes
+// from schema validation, and reports whether it did.
+func writeValidationError(c *gin.Context, err error) bool {
+	var validationErr *schema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return false
+	}
+
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":      "Request body does not match the plan schema",
+		"violations": validationErr.Violations,
+	})
+	return true
 }
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"info7255-bigdata-app/models"
+	"info7255-bigdata-app/services"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ReindexHandler struct {
+	service services.ReindexService
+}
+
+func NewReindexHandler(service services.ReindexService) *ReindexHandler {
+	return &ReindexHandler{
+		service: service,
+	}
+}
+
+func (rh *ReindexHandler) StartReindex(c *gin.Context) {
+	var request models.StartReindexRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+
+	job, err := rh.service.Start(c, request.Restart)
+	if err != nil {
+		log.Printf("Failed to start reindex with err : %v", err.Error())
+		if err.Error() == "REINDEX_RUNNING" {
+			c.JSON(http.StatusConflict, gin.H{"error": "A reindex is already running"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.Header("Location", "/v1/admin/reindex")
+	c.JSON(http.StatusAccepted, job)
+}
+
+func (rh *ReindexHandler) GetReindexStatus(c *gin.Context) {
+	job, err := rh.service.Status(c)
+	if err != nil {
+		if err.Error() == "KEY_NOT_FOUND" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No reindex has been run"})
+			return
+		}
+		log.Printf("Failed to fetch reindex status with err : %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"info7255-bigdata-app/models"
+	"info7255-bigdata-app/services"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SchemaHandler struct {
+	service services.SchemaService
+}
+
+func NewSchemaHandler(service services.SchemaService) *SchemaHandler {
+	return &SchemaHandler{
+		service: service,
+	}
+}
+
+func (sh *SchemaHandler) ListSchemas(c *gin.Context) {
+	summaries, err := sh.service.ListSchemas(c)
+	if err != nil {
+		log.Printf("Failed to list schemas with err : %v", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, summaries)
+}
+
+func (sh *SchemaHandler) CreateSchema(c *gin.Context) {
+	objectType := c.Param("objectType")
+
+	body, err := c.GetRawData()
+	if err != nil || len(body) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Schema body is required"})
+		return
+	}
+
+	activate := c.DefaultQuery("activate", "true") != "false"
+	version, err := sh.service.CreateSchema(c, objectType, body, activate)
+	if err != nil {
+		log.Printf("Failed to create schema with err : %v", err.Error())
+		writeSchemaError(c, err)
+		return
+	}
+
+	version.Schema = nil
+	c.Header("Location", "/v1/schema/"+objectType+"/versions/"+strconv.Itoa(version.Version))
+	c.JSON(http.StatusCreated, version)
+}
+
+func (sh *SchemaHandler) GetActiveSchema(c *gin.Context) {
+	version, err := sh.service.GetActiveSchema(c, c.Param("objectType"))
+	if err != nil {
+		log.Printf("Failed to fetch active schema with err : %v", err.Error())
+		writeSchemaError(c, err)
+		return
+	}
+
+	c.Header("X-Schema-Version", strconv.Itoa(version.Version))
+	c.Data(http.StatusOK, "application/schema+json", version.Schema)
+}
+
+func (sh *SchemaHandler) ListVersions(c *gin.Context) {
+	versions, err := sh.service.ListVersions(c, c.Param("objectType"))
+	if err != nil {
+		log.Printf("Failed to list schema versions with err : %v", err.Error())
+		writeSchemaError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, versions)
+}
+
+func (sh *SchemaHandler) GetSchemaVersion(c *gin.Context) {
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "version must be a number"})
+		return
+	}
+
+	sv, err := sh.service.GetSchema(c, c.Param("objectType"), version)
+	if err != nil {
+		log.Printf("Failed to fetch schema version with err : %v", err.Error())
+		writeSchemaError(c, err)
+		return
+	}
+
+	c.Header("X-Schema-Version", strconv.Itoa(sv.Version))
+	c.Data(http.StatusOK, "application/schema+json", sv.Schema)
+}
+
+func (sh *SchemaHandler) ActivateSchema(c *gin.Context) {
+	var req models.ActivateSchemaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "version is required"})
+		return
+	}
+
+	if err := sh.service.ActivateSchema(c, c.Param("objectType"), req.Version); err != nil {
+		log.Printf("Failed to activate schema with err : %v", err.Error())
+		writeSchemaError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Schema activated successfully"})
+}
+
+func writeSchemaError(c *gin.Context, err error) {
+	switch {
+	case err.Error() == "KEY_NOT_FOUND":
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schema not found"})
+	case err.Error() == "UNKNOWN_OBJECT_TYPE":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "objectType must be one of " + strings.Join(services.SchemaObjectTypes, ", ")})
+	case strings.HasPrefix(err.Error(), "INVALID_SCHEMA"):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
@@ -0,0 +1,37 @@
+package models
+
+// ConsistencyIssue is one index document that does not match Redis.
+//   - missing: stored in Redis but not indexed
+//   - stale: indexed with content that differs from Redis
+//   - orphaned: indexed but no longer stored in Redis
+type ConsistencyIssue struct {
+	Kind     string `json:"kind"`
+	ObjectId string `json:"objectId"`
+	// DocumentId is the id of the index document, which for orphans can
+	// differ from the one the current layout gives the object.
+	DocumentId string `json:"documentId"`
+	Routing    string `json:"routing,omitempty"`
+	// PlanId is the plan the object belongs to in Redis, empty for orphans.
+	PlanId string `json:"planId,omitempty"`
+}
+
+type ConsistencyReport struct {
+	CheckedAt string `json:"checkedAt"`
+	Plans     int    `json:"plans"`
+	// Expected counts the documents the plans in Redis should produce,
+	// Indexed the documents found in the index.
+	Expected int                `json:"expected"`
+	Indexed  int                `json:"indexed"`
+	Missing  int                `json:"missing"`
+	Stale    int                `json:"stale"`
+	Orphaned int                `json:"orphaned"`
+	Issues   []ConsistencyIssue `json:"issues"`
+	// Repair is set when corrective messages were queued; it counts them.
+	Repair *ConsistencyRepair `json:"repair,omitempty"`
+}
+
+type ConsistencyRepair struct {
+	Reindexed int `json:"reindexed"`
+	Removed   int `json:"removed"`
+	Messages  int `json:"messages"`
+}
@@ -0,0 +1,21 @@
+package models
+
+// DeadLetter is a message parked in a dead-letter queue after the consumer
+// gave up on it.
+type DeadLetter struct {
+	OriginalQueue string `json:"originalQueue"`
+	Reason        string `json:"reason"`
+	FailedAt      string `json:"failedAt,omitempty"`
+	Attempts      int    `json:"attempts"`
+	// Body is kept as text because a message can be dead-lettered for not
+	// being valid JSON.
+	Body string `json:"body"`
+}
+
+type ReplayResult struct {
+	Replayed int `json:"replayed"`
+	// Rejected counts the messages that could no longer be applied and
+	// were quarantined instead, Reasons says why for each.
+	Rejected int      `json:"rejected"`
+	Reasons  []string `json:"reasons,omitempty"`
+}
@@ -0,0 +1,21 @@
+package models
+
+// PlanListQuery selects a page of GET /v1/plans.
+type PlanListQuery struct {
+	// ObjectType lists objects of this type, plan by default.
+	ObjectType string
+	// Org only lists objects whose _org matches, when set.
+	Org string
+	// Sort is "objectId" or "creationDate"; Order is "asc" or "desc".
+	Sort  string
+	Order string
+	Limit int
+	// Cursor is the NextCursor of the previous page, empty for the first.
+	Cursor string
+}
+
+type PlanPage struct {
+	Items []map[string]interface{} `json:"items"`
+	// NextCursor fetches the following page. It is omitted on the last one.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
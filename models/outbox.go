@@ -0,0 +1,15 @@
+package models
+
+import "encoding/json"
+
+// OutboxEntry is a message written in the same Redis transaction as the
+// change it describes. The relay publishes it afterwards.
+type OutboxEntry struct {
+	ID            int64           `json:"id"`
+	Queue         string          `json:"queue"`
+	Payload       json.RawMessage `json:"payload"`
+	Attempts      int             `json:"attempts"`
+	CreatedAt     string          `json:"createdAt"`
+	NextAttemptAt string          `json:"nextAttemptAt,omitempty"`
+	LastError     string          `json:"lastError,omitempty"`
+}
@@ -1,96 +1,43 @@
 package models
 
-type PlanMessage struct {
-	Operation string `json:"operation"`
-	Plan      Plan   `json:"plan"`
-}
-
-type SearchPlanRequest struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
-}
-
-type Plan struct {
-	PlanCostShares     *PlanCostShares     `json:"planCostShares,omitempty"`
-	LinkedPlanServices []LinkedPlanService `json:"linkedPlanServices,omitempty"`
-	// PlanStatus         string                 `json:"planStatus" binding:"required"`
-	CreationDate string                 `json:"creationDate" binding:"required"`
-	ObjectId     string                 `json:"objectId" binding:"required"`
-	ObjectType   string                 `json:"objectType" binding:"required"`
-	Org          string                 `json:"_org" binding:"required"`
-	PlanJoin     map[string]interface{} `json:"plan_join,omitempty"`
-}
-
-type PlanCostShares struct {
-	Deductible int                    `json:"deductible" binding:"required"`
-	Copay      int                    `json:"copay" binding:"required"`
-	ObjectId   string                 `json:"objectId" binding:"required"`
-	ObjectType string                 `json:"objectType" binding:"required"`
-	Org        string                 `json:"_org" binding:"required"`
-	PlanJoin   map[string]interface{} `json:"plan_join,omitempty"`
-}
-
-type LinkedService struct {
-	Name       string                 `json:"name" binding:"required"`
-	ObjectId   string                 `json:"objectId" binding:"required"`
-	ObjectType string                 `json:"objectType" binding:"required"`
-	Org        string                 `json:"_org" binding:"required"`
-	PlanJoin   map[string]interface{} `json:"plan_join,omitempty"`
-}
-
-type PlanServiceCostShares struct {
-	Deductible int                    `json:"deductible" binding:"required"`
-	Copay      int                    `json:"copay" binding:"required"`
-	ObjectId   string                 `json:"objectId" binding:"required"`
-	ObjectType string                 `json:"objectType" binding:"required"`
-	Org        string                 `json:"_org" binding:"required"`
-	PlanJoin   map[string]interface{} `json:"plan_join,omitempty"`
-}
+import "time"
 
-type LinkedPlanService struct {
-	LinkedService         LinkedService          `json:"linkedService" binding:"required"`
-	PlanServiceCostShares PlanServiceCostShares  `json:"planserviceCostShares" binding:"required"`
-	ObjectId              string                 `json:"objectId" binding:"required"`
-	ObjectType            string                 `json:"objectType" binding:"required"`
-	Org                   string                 `json:"_org" binding:"required"`
-	PlanJoin              map[string]interface{} `json:"plan_join,omitempty"`
-}
-
-func (plan *Plan) UpdatePlan(updatedPlan Plan) {
-	plan.PlanCostShares = updatedPlan.PlanCostShares
-	plan.LinkedPlanServices = updatedPlan.LinkedPlanServices
-	// plan.PlanStatus = updatedPlan.PlanStatus
-	plan.CreationDate = updatedPlan.CreationDate
-	plan.Org = updatedPlan.Org
-}
-
-func (l *LinkedPlanService) UpdateLinkedPlanService(updatedLinkedPlanService LinkedPlanService) {
-	l.LinkedService = updatedLinkedPlanService.LinkedService
-	l.PlanServiceCostShares = updatedLinkedPlanService.PlanServiceCostShares
-	l.ObjectId = updatedLinkedPlanService.ObjectId
-	l.ObjectType = updatedLinkedPlanService.ObjectType
-	l.Org = updatedLinkedPlanService.Org
-}
-
-func (p *PlanCostShares) UpdatePlanCostShares(updatedPlanCostShares PlanCostShares) {
-	p.Deductible = updatedPlanCostShares.Deductible
-	p.Copay = updatedPlanCostShares.Copay
-	p.ObjectId = updatedPlanCostShares.ObjectId
-	p.ObjectType = updatedPlanCostShares.ObjectType
-	p.Org = updatedPlanCostShares.Org
-}
-
-func (p *LinkedService) UpdateLinkedService(updatedLinkedService LinkedService) {
-	p.ObjectId = updatedLinkedService.ObjectId
-	p.ObjectType = updatedLinkedService.ObjectType
-	p.Name = updatedLinkedService.Name
-	p.Org = updatedLinkedService.Org
-}
-
-func (p *PlanServiceCostShares) UpdatePlanServiceCostShares(updatedPlanServiceCostShares PlanServiceCostShares) {
-	p.Deductible = updatedPlanServiceCostShares.Deductible
-	p.Copay = updatedPlanServiceCostShares.Copay
-	p.ObjectId = updatedPlanServiceCostShares.ObjectId
-	p.ObjectType = updatedPlanServiceCostShares.ObjectType
-	p.Org = updatedPlanServiceCostShares.Org
+// PlanMessage carries the plan document exactly as stored, so every property
+// of it reaches the indexer.
+type PlanMessage struct {
+	Operation string                 `json:"operation"`
+	Plan      map[string]interface{} `json:"plan,omitempty"`
+	// Removed lists index documents to delete in addition to whatever the
+	// operation does with Plan.
+	Removed []IndexRef `json:"removed,omitempty"`
+	// Versions holds the version of every object the write touched, by
+	// objectId. The indexer uses them as external versions, so a message
+	// that arrives late cannot overwrite a newer document.
+	Versions map[string]int64 `json:"versions,omitempty"`
+	// CommittedAt is when the write was committed, RFC 3339. Versions only
+	// protect against a late message while Elasticsearch still remembers
+	// the deletes it could undo, so older messages are not applied.
+	CommittedAt string `json:"committedAt,omitempty"`
+}
+
+// IndexRef addresses the document of object ID in the plan Routing points
+// to. An object shared by several plans has a document in each of them.
+type IndexRef struct {
+	ID      string `json:"id"`
+	Routing string `json:"routing,omitempty"`
+	// DocumentId is the id of the document when it is not the one
+	// elastic.DocumentID gives it, e.g. one indexed under an older layout.
+	DocumentId string `json:"documentId,omitempty"`
+}
+
+// WriteOptions carries per-request settings of a plan write.
+type WriteOptions struct {
+	// Retention overrides how long the plan is kept; zero keeps it forever.
+	// Nil applies the retention policy of its objectType on create and
+	// update, and leaves the current expiry alone on patch.
+	Retention *time.Duration
+	// IfVersions makes the write fail with VERSION_CONFLICT unless the
+	// graph of the object still holds exactly these versions, by objectId.
+	// Nil retries the write against concurrent writes instead.
+	IfVersions map[string]int64
 }
@@ -0,0 +1,22 @@
+package models
+
+// ReindexJob tracks a rebuild of the search index from Redis. LastObjectId is
+// the checkpoint: plans are replayed in objectId order and everything up to
+// and including it has been queued for indexing.
+type ReindexJob struct {
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	Total        int    `json:"total"`
+	Processed    int    `json:"processed"`
+	Skipped      int    `json:"skipped"`
+	LastObjectId string `json:"lastObjectId,omitempty"`
+	StartedAt    string `json:"startedAt"`
+	UpdatedAt    string `json:"updatedAt"`
+	FinishedAt   string `json:"finishedAt,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+type StartReindexRequest struct {
+	// Restart discards the checkpoint of an unfinished job and starts over.
+	Restart bool `json:"restart"`
+}
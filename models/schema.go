@@ -0,0 +1,29 @@
+package models
+
+import "encoding/json"
+
+type SchemaVersion struct {
+	ObjectType string          `json:"objectType"`
+	Version    int             `json:"version"`
+	Active     bool            `json:"active"`
+	CreatedAt  string          `json:"createdAt"`
+	Schema     json.RawMessage `json:"schema,omitempty"`
+}
+
+type SchemaSummary struct {
+	ObjectType    string `json:"objectType"`
+	ActiveVersion int    `json:"activeVersion"`
+	LatestVersion int    `json:"latestVersion"`
+}
+
+type ActivateSchemaRequest struct {
+	Version int `json:"version" binding:"required"`
+}
+
+// ObjectMeta is stored next to every object and records how it was written.
+type ObjectMeta struct {
+	ObjectType    string `json:"objectType"`
+	SchemaVersion int    `json:"schemaVersion"`
+	// ModifiedAt is when the object was last written, in RFC 3339.
+	ModifiedAt string `json:"modifiedAt,omitempty"`
+}
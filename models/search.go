@@ -0,0 +1,84 @@
+package models
+
+// SearchClauses combine conditions like an Elasticsearch bool query.
+// Conditions in Must all have to match, at least MinimumShouldMatch of Should
+// (one by default when nothing else constrains the search), and none of
+// MustNot. Filter works like Must without affecting the score.
+type SearchClauses struct {
+	Must               []SearchCondition `json:"must,omitempty"`
+	Should             []SearchCondition `json:"should,omitempty"`
+	MustNot            []SearchCondition `json:"mustNot,omitempty"`
+	Filter             []SearchCondition `json:"filter,omitempty"`
+	MinimumShouldMatch *int              `json:"minimumShouldMatch,omitempty"`
+}
+
+// SearchPlanRequest is the body of POST /v1/search.
+type SearchPlanRequest struct {
+	SearchClauses
+
+	Sort []SearchSort `json:"sort,omitempty"`
+	// Fields limits the returned _source to these fields.
+	Fields []string `json:"fields,omitempty"`
+	From   *int     `json:"from,omitempty"`
+	Size   *int     `json:"size,omitempty"`
+
+	// Key and Value are the original single match query, still accepted as a
+	// shorthand for one match condition in Must.
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// SearchCondition tests one field, or relates a document to its parent or
+// children. Exactly one of Match, Term, Terms, Range, Exists, HasChild or
+// HasParent is set; the last two take no Field.
+//   - match: full text match, for text and keyword fields
+//   - term / terms: exact value(s) of a keyword field
+//   - range: bounds on a number or date field
+//   - exists: the field has a value
+//   - hasChild: the document has a child of a type matching the clauses
+//   - hasParent: the document's parent is of a type matching the clauses
+type SearchCondition struct {
+	Field     string        `json:"field,omitempty"`
+	Match     interface{}   `json:"match,omitempty"`
+	Term      interface{}   `json:"term,omitempty"`
+	Terms     []interface{} `json:"terms,omitempty"`
+	Range     *SearchRange  `json:"range,omitempty"`
+	Exists    bool          `json:"exists,omitempty"`
+	HasChild  *SearchJoin   `json:"hasChild,omitempty"`
+	HasParent *SearchJoin   `json:"hasParent,omitempty"`
+}
+
+// SearchJoin is a has_child or has_parent query over the plan_join relation.
+// Type is the relation of the child or parent, e.g. linkedPlanServices.
+type SearchJoin struct {
+	Type string `json:"type"`
+	SearchClauses
+	// MinChildren and MaxChildren bound how many children have to match.
+	// They only apply to hasChild.
+	MinChildren *int `json:"minChildren,omitempty"`
+	MaxChildren *int `json:"maxChildren,omitempty"`
+	// InnerHits returns the matching children or parent with each hit.
+	InnerHits *SearchInnerHits `json:"innerHits,omitempty"`
+}
+
+type SearchInnerHits struct {
+	// Name defaults to Type; two joins on the same type need different names.
+	Name   string   `json:"name,omitempty"`
+	Size   *int     `json:"size,omitempty"`
+	Fields []string `json:"fields,omitempty"`
+}
+
+// SearchRange bounds a number or a date. Dates use the index format,
+// MM-dd-yyyy.
+type SearchRange struct {
+	Gt  interface{} `json:"gt,omitempty"`
+	Gte interface{} `json:"gte,omitempty"`
+	Lt  interface{} `json:"lt,omitempty"`
+	Lte interface{} `json:"lte,omitempty"`
+}
+
+type SearchSort struct {
+	Field string `json:"field"`
+	// Order is "asc" (the default) or "desc".
+	Order string `json:"order,omitempty"`
+}
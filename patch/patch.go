@@ -0,0 +1,408 @@
+// Package patch applies JSON Merge Patch (RFC 7396) and JSON Patch
+// (RFC 6902) documents to decoded JSON values.
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MergePatchType is the media type of a JSON Merge Patch.
+	MergePatchType = "application/merge-patch+json"
+	// JSONPatchType is the media type of a JSON Patch.
+	JSONPatchType = "application/json-patch+json"
+)
+
+// Kinds of Error.
+const (
+	// Invalid is a patch document that is malformed in itself.
+	Invalid = "invalid"
+	// Unprocessable is a well-formed patch that does not fit the document,
+	// e.g. a path that does not exist.
+	Unprocessable = "unprocessable"
+	// TestFailed is a test operation whose value did not match.
+	TestFailed = "test_failed"
+)
+
+// Error reports why a patch was not applied. Nothing of the patch is applied
+// when one operation fails.
+type Error struct {
+	Kind string
+	// Index is the position of the failed operation, -1 when the patch as a
+	// whole is at fault.
+	Index   int
+	Op      string
+	Path    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Index < 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("operation %d (%s %s): %s", e.Index, e.Op, pathOrRoot(e.Path), e.Message)
+}
+
+// Operation is one entry of a JSON Patch.
+type Operation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Merge returns target with the merge patch applied (RFC 7396 section 2).
+// Objects are merged member by member, a null member removes the member and
+// anything else, arrays included, replaces the target value. target is not
+// modified.
+func Merge(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return clone(patch)
+	}
+
+	result := make(map[string]interface{})
+	if targetObj, ok := target.(map[string]interface{}); ok {
+		for key, value := range targetObj {
+			result[key] = value
+		}
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(result, key)
+			continue
+		}
+		result[key] = Merge(result[key], value)
+	}
+	return result
+}
+
+// ParseOperations decodes a JSON Patch document and checks that every
+// operation is complete, so Apply only fails on the document it is applied to.
+func ParseOperations(data []byte) ([]Operation, error) {
+	var raw []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, &Error{Kind: Invalid, Index: -1, Message: "JSON Patch must be an array of operation objects"}
+	}
+
+	ops := make([]Operation, 0, len(raw))
+	for i, fields := range raw {
+		invalid := func(format string, args ...interface{}) error {
+			return &Error{Kind: Invalid, Index: i, Message: fmt.Sprintf(format, args...)}
+		}
+
+		var op Operation
+		if err := json.Unmarshal(fields["op"], &op.Op); err != nil {
+			return nil, invalid("op must be a string")
+		}
+		if err := json.Unmarshal(fields["path"], &op.Path); err != nil {
+			return nil, invalid("path must be a string")
+		}
+		if _, err := splitPointer(op.Path); err != nil {
+			return nil, invalid("path: %v", err)
+		}
+
+		switch op.Op {
+		case "add", "replace", "test":
+			value, ok := fields["value"]
+			if !ok {
+				return nil, invalid("%s needs a value", op.Op)
+			}
+			if err := json.Unmarshal(value, &op.Value); err != nil {
+				return nil, invalid("value: %v", err)
+			}
+		case "move", "copy":
+			if err := json.Unmarshal(fields["from"], &op.From); err != nil {
+				return nil, invalid("%s needs from as a string", op.Op)
+			}
+			if _, err := splitPointer(op.From); err != nil {
+				return nil, invalid("from: %v", err)
+			}
+			if op.Op == "move" && strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, invalid("cannot move %s into one of its children", pathOrRoot(op.From))
+			}
+		case "remove":
+		default:
+			return nil, invalid("unknown op %q", op.Op)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// Apply returns doc with ops applied in order (RFC 6902 section 4). doc is
+// not modified, and nothing is applied if any operation fails.
+func Apply(doc interface{}, ops []Operation) (interface{}, error) {
+	result := clone(doc)
+	for i, op := range ops {
+		var err error
+		result, err = apply(result, op)
+		if err != nil {
+			e := &Error{Kind: Unprocessable, Index: i, Op: op.Op, Path: op.Path, Message: err.Error()}
+			if failed, ok := err.(testFailure); ok {
+				e.Kind = TestFailed
+				e.Message = string(failed)
+			}
+			return nil, e
+		}
+	}
+	return result, nil
+}
+
+// testFailure is returned by apply when a test operation does not match.
+type testFailure string
+
+func (t testFailure) Error() string { return string(t) }
+
+func apply(doc interface{}, op Operation) (interface{}, error) {
+	path, err := splitPointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add":
+		return add(doc, path, clone(op.Value))
+	case "remove":
+		result, _, err := remove(doc, path)
+		return result, err
+	case "replace":
+		if _, err := get(doc, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return clone(op.Value), nil
+		}
+		result, _, err := remove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return add(result, path, clone(op.Value))
+	case "move":
+		from, err := splitPointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		result, value, err := remove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(result, path, value)
+	case "copy":
+		from, err := splitPointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := get(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, clone(value))
+	case "test":
+		value, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(value, normalize(op.Value)) {
+			return nil, testFailure("value does not match")
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("unknown op %q", op.Op)
+	}
+}
+
+// get returns the value path points to.
+func get(doc interface{}, path []string) (interface{}, error) {
+	current := doc
+	for i, token := range path {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("%s does not exist", joinPointer(path[:i+1]))
+			}
+			current = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", joinPointer(path[:i+1]), err)
+			}
+			current = node[index]
+		default:
+			return nil, fmt.Errorf("%s is not an object or array", joinPointer(path[:i]))
+		}
+	}
+	return current, nil
+}
+
+// add inserts value at path. Members are added or replaced, array items are
+// inserted before the index, "-" appends.
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return update(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			index := len(node)
+			if token != "-" {
+				var err error
+				if index, err = arrayIndex(token, len(node)); err != nil {
+					return nil, err
+				}
+			}
+			node = append(node, nil)
+			copy(node[index+1:], node[index:])
+			node[index] = value
+			return node, nil
+		default:
+			return nil, fmt.Errorf("cannot add to a %T", parent)
+		}
+	})
+}
+
+// remove deletes the value at path and returns it.
+func remove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("cannot remove the whole document")
+	}
+
+	var removed interface{}
+	result, err := update(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("%s does not exist", joinPointer(path))
+			}
+			removed = value
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			removed = node[index]
+			return append(node[:index], node[index+1:]...), nil
+		default:
+			return nil, fmt.Errorf("cannot remove from a %T", parent)
+		}
+	})
+	return result, removed, err
+}
+
+// update calls fn with the container holding the last token of path and
+// puts what fn returns back in place of that container.
+func update(doc interface{}, path []string, fn func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+
+	child, err := get(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = update(child, path[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[path[0]] = child
+	case []interface{}:
+		index, _ := arrayIndex(path[0], len(node)-1)
+		node[index] = child
+	}
+	return doc, nil
+}
+
+// arrayIndex parses an array index token that must not exceed max.
+func arrayIndex(token string, max int) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if index > max {
+		return 0, fmt.Errorf("array index %d is out of bounds", index)
+	}
+	return index, nil
+}
+
+// splitPointer splits a JSON Pointer (RFC 6901) into its unescaped tokens.
+func splitPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("JSON pointer %q must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		token = strings.ReplaceAll(token, "~1", "/")
+		tokens[i] = strings.ReplaceAll(token, "~0", "~")
+	}
+	return tokens, nil
+}
+
+func joinPointer(tokens []string) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		token = strings.ReplaceAll(token, "~", "~0")
+		b.WriteString("/" + strings.ReplaceAll(token, "/", "~1"))
+	}
+	return pathOrRoot(b.String())
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// clone deep copies a decoded JSON value.
+func clone(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = clone(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = clone(item)
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+// normalize round-trips value through JSON, so numbers compare as the
+// float64 values decoded documents hold.
+func normalize(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return value
+	}
+	return out
+}
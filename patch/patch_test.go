@@ -0,0 +1,125 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func decode(t *testing.T, data string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		t.Fatalf("decoding %s: %v", data, err)
+	}
+	return value
+}
+
+func TestMerge(t *testing.T) {
+	// RFC 7396 appendix A
+	tests := []struct{ target, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tt := range tests {
+		target := decode(t, tt.target)
+		got := Merge(target, decode(t, tt.patch))
+		if !reflect.DeepEqual(got, decode(t, tt.want)) {
+			t.Errorf("Merge(%s, %s) = %v, want %s", tt.target, tt.patch, got, tt.want)
+		}
+		if !reflect.DeepEqual(target, decode(t, tt.target)) {
+			t.Errorf("Merge(%s, %s) modified the target", tt.target, tt.patch)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	// Mostly RFC 6902 appendix A
+	tests := []struct{ doc, patch, want string }{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":"baz"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"}]`, `{"foo":{"bar":1},"baz":{"bar":1}}`},
+		{`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10},{"op":"remove","path":"/~1"}]`, `{"~1":10}`},
+		{`{"a":{"b":[1,{"c":2}]}}`, `[{"op":"test","path":"/a/b/1/c","value":2},{"op":"replace","path":"/a/b/1/c","value":3}]`, `{"a":{"b":[1,{"c":3}]}}`},
+	}
+	for _, tt := range tests {
+		ops, err := ParseOperations([]byte(tt.patch))
+		if err != nil {
+			t.Fatalf("ParseOperations(%s): %v", tt.patch, err)
+		}
+		doc := decode(t, tt.doc)
+		got, err := Apply(doc, ops)
+		if err != nil {
+			t.Fatalf("Apply(%s, %s): %v", tt.doc, tt.patch, err)
+		}
+		if !reflect.DeepEqual(got, decode(t, tt.want)) {
+			t.Errorf("Apply(%s, %s) = %v, want %s", tt.doc, tt.patch, got, tt.want)
+		}
+		if !reflect.DeepEqual(doc, decode(t, tt.doc)) {
+			t.Errorf("Apply(%s, %s) modified the document", tt.doc, tt.patch)
+		}
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []struct {
+		doc, patch string
+		kind       string
+		index      int
+	}{
+		{`{"foo":"bar"}`, `[{"op":"test","path":"/foo","value":"baz"}]`, TestFailed, 0},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/a","value":1},{"op":"remove","path":"/missing"}]`, Unprocessable, 1},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, Unprocessable, 0},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":"qux"}]`, Unprocessable, 0},
+		{`{"foo":["bar"]}`, `[{"op":"replace","path":"/foo/01","value":"qux"}]`, Unprocessable, 0},
+	}
+	for _, tt := range tests {
+		ops, err := ParseOperations([]byte(tt.patch))
+		if err != nil {
+			t.Fatalf("ParseOperations(%s): %v", tt.patch, err)
+		}
+		doc := decode(t, tt.doc)
+		_, err = Apply(doc, ops)
+		var patchErr *Error
+		if !errors.As(err, &patchErr) || patchErr.Kind != tt.kind || patchErr.Index != tt.index {
+			t.Errorf("Apply(%s, %s) = %v, want a %s error at operation %d", tt.doc, tt.patch, err, tt.kind, tt.index)
+		}
+		if !reflect.DeepEqual(doc, decode(t, tt.doc)) {
+			t.Errorf("Apply(%s, %s) modified the document", tt.doc, tt.patch)
+		}
+	}
+}
+
+func TestParseOperationsRejectsMalformedPatches(t *testing.T) {
+	patches := []string{
+		`{"op":"add","path":"/a","value":1}`,
+		`[{"op":"add","path":"/a"}]`,
+		`[{"op":"jump","path":"/a"}]`,
+		`[{"op":"remove","path":"a"}]`,
+		`[{"op":"copy","path":"/a"}]`,
+		`[{"op":"move","from":"/a","path":"/a/b"}]`,
+	}
+	for _, data := range patches {
+		_, err := ParseOperations([]byte(data))
+		var patchErr *Error
+		if !errors.As(err, &patchErr) || patchErr.Kind != Invalid {
+			t.Errorf("ParseOperations(%s) = %v, want an invalid patch error", data, err)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"info7255-bigdata-app/models"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DeadLetter parks d in the dead-letter queue of queueName, recording why it
+// failed and how often it was attempted. The caller still has to settle d.
+// On a confirm mode channel it waits for the broker to accept the copy.
+func DeadLetter(ch *amqp.Channel, queueName string, d amqp.Delivery, attempts int, reason error) error {
+	return park(ch, DeadLetterExchange, queueName, queueName, d, attempts, reason)
+}
+
+// Quarantine parks a poison message of queueName, one that can never be
+// processed, in its quarantine queue with the same headers as DeadLetter.
+func Quarantine(ch *amqp.Channel, queueName string, d amqp.Delivery, attempts int, reason error) error {
+	return park(ch, "", QuarantineQueueName(queueName), queueName, d, attempts, reason)
+}
+
+func park(ch *amqp.Channel, exchange, key, queueName string, d amqp.Delivery, attempts int, reason error) error {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[HeaderFailureReason] = reason.Error()
+	headers[HeaderFailedAt] = time.Now().UTC().Format(time.RFC3339)
+	headers[HeaderOriginalQueue] = queueName
+	headers[HeaderAttempts] = int32(attempts)
+
+	return publishConfirmed(ch, exchange, key, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		Body:         d.Body,
+	})
+}
+
+// DeadLetters inspects and replays the queues messages of a work queue are
+// parked in, i.e. its dead-letter and quarantine queues.
+type DeadLetters interface {
+	Peek(queueName, parkedQueue string, limit int) ([]models.DeadLetter, error)
+	// Replay moves parked messages back onto their original queue. Those
+	// check fails for are quarantined instead and counted as rejected.
+	Replay(queueName, parkedQueue string, limit int, check func(body []byte) error) (models.ReplayResult, error)
+}
+
+type deadLetters struct {
+	url string
+}
+
+func NewDeadLetters(url string) DeadLetters {
+	return &deadLetters{url: url}
+}
+
+// Peek returns up to limit parked messages without removing them. The
+// messages are held unacknowledged until the channel closes, which puts them
+// back.
+func (dl *deadLetters) Peek(queueName, parkedQueue string, limit int) ([]models.DeadLetter, error) {
+	conn, ch, err := dl.open(queueName)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer ch.Close()
+
+	letters := make([]models.DeadLetter, 0, limit)
+	for len(letters) < limit {
+		d, ok, err := ch.Get(parkedQueue, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dead letters: %w", err)
+		}
+		if !ok {
+			break
+		}
+		letters = append(letters, toDeadLetter(queueName, d))
+	}
+	return letters, nil
+}
+
+// Replay takes up to limit parked messages, oldest first. Each one check
+// accepts is moved back onto its original queue, every other one is moved
+// to the quarantine queue with the reason check gave, so it is neither
+// applied nor replayed again by accident. A message is only removed from
+// parkedQueue once the broker confirmed the republish.
+func (dl *deadLetters) Replay(queueName, parkedQueue string, limit int, check func(body []byte) error) (models.ReplayResult, error) {
+	var result models.ReplayResult
+	conn, ch, err := dl.open(queueName)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	defer ch.Close()
+
+	if err := ch.Confirm(false); err != nil {
+		return result, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+
+	for result.Replayed+result.Rejected < limit {
+		d, ok, err := ch.Get(parkedQueue, false)
+		if err != nil {
+			return result, fmt.Errorf("failed to read dead letters: %w", err)
+		}
+		if !ok {
+			break
+		}
+
+		target := queueName
+		if original, ok := d.Headers[HeaderOriginalQueue].(string); ok && original != "" {
+			target = original
+		}
+
+		if reason := check(d.Body); reason != nil {
+			if err := park(ch, "", QuarantineQueueName(target), target, d, toDeadLetter(target, d).Attempts, reason); err != nil {
+				d.Nack(false, true)
+				return result, fmt.Errorf("failed to quarantine dead letter: %w", err)
+			}
+			if err := d.Ack(false); err != nil {
+				return result, fmt.Errorf("failed to remove rejected dead letter: %w", err)
+			}
+			result.Rejected++
+			result.Reasons = append(result.Reasons, reason.Error())
+			continue
+		}
+
+		if err := republish(ch, target, d); err != nil {
+			d.Nack(false, true)
+			return result, err
+		}
+		if err := d.Ack(false); err != nil {
+			return result, fmt.Errorf("failed to remove replayed dead letter: %w", err)
+		}
+		result.Replayed++
+	}
+	return result, nil
+}
+
+func (dl *deadLetters) open(queueName string) (*amqp.Connection, *amqp.Channel, error) {
+	conn, err := amqp.Dial(dl.url)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to open RabbitMQ channel: %w", err)
+	}
+	if _, err := DeclareQueue(ch, queueName); err != nil {
+		ch.Close()
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to declare RabbitMQ queue: %w", err)
+	}
+	return conn, ch, nil
+}
+
+// republish sends d to queueName without the failure headers and waits for
+// the broker to confirm it.
+func republish(ch *amqp.Channel, queueName string, d amqp.Delivery) error {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		switch k {
+		case HeaderFailureReason, HeaderFailedAt, HeaderOriginalQueue, HeaderAttempts, HeaderRetryCount, "x-death":
+			continue
+		}
+		headers[k] = v
+	}
+
+	if err := publishConfirmed(ch, "", queueName, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		Body:         d.Body,
+	}); err != nil {
+		return fmt.Errorf("failed to replay dead letter: %w", err)
+	}
+	return nil
+}
+
+func toDeadLetter(queueName string, d amqp.Delivery) models.DeadLetter {
+	letter := models.DeadLetter{
+		OriginalQueue: queueName,
+		Body:          string(d.Body),
+	}
+	if original, ok := d.Headers[HeaderOriginalQueue].(string); ok && original != "" {
+		letter.OriginalQueue = original
+	}
+	if reason, ok := d.Headers[HeaderFailureReason].(string); ok {
+		letter.Reason = reason
+	} else if deaths, ok := d.Headers["x-death"].([]interface{}); ok && len(deaths) > 0 {
+		// Dead-lettered by the broker itself, e.g. a reject without requeue
+		if death, ok := deaths[0].(amqp.Table); ok {
+			letter.Reason, _ = death["reason"].(string)
+		}
+	}
+	if failedAt, ok := d.Headers[HeaderFailedAt].(string); ok {
+		letter.FailedAt = failedAt
+	}
+	switch attempts := d.Headers[HeaderAttempts].(type) {
+	case int32:
+		letter.Attempts = int(attempts)
+	case int64:
+		letter.Attempts = int(attempts)
+	}
+	return letter
+}
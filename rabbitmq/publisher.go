@@ -0,0 +1,221 @@
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+// PooledPublisher keeps one connection open and reuses confirm mode channels
+// across publishes. A message only counts as published once the broker has
+// acked it.
+type PooledPublisher struct {
+	url            string
+	poolSize       int
+	confirmTimeout time.Duration
+
+	mu     sync.Mutex
+	conn   *amqp.Connection
+	idle   []*pooledChannel
+	closed bool
+}
+
+type pooledChannel struct {
+	ch *amqp.Channel
+	// declared remembers the queues already declared on this channel.
+	declared map[string]bool
+}
+
+// NewPublisher creates a publisher for url that keeps up to poolSize idle
+// channels and waits at most confirmTimeout for each broker ack. It connects
+// on first use, so the broker does not need to be up yet.
+func NewPublisher(url string, poolSize int, confirmTimeout time.Duration) *PooledPublisher {
+	return &PooledPublisher{
+		url:            url,
+		poolSize:       poolSize,
+		confirmTimeout: confirmTimeout,
+	}
+}
+
+func (p *PooledPublisher) PublishMessage(queueName string, message interface{}) error {
+	messageBody, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	pc, err := p.acquire()
+	if err != nil {
+		return err
+	}
+
+	if err := p.publish(pc, queueName, messageBody); err != nil {
+		// The channel may be closed or out of step with its confirms, so it
+		// is never handed out again.
+		pc.ch.Close()
+		return err
+	}
+
+	p.release(pc)
+	return nil
+}
+
+func (p *PooledPublisher) publish(pc *pooledChannel, queueName string, body []byte) error {
+	if !pc.declared[queueName] {
+		if _, err := DeclareQueue(pc.ch, queueName); err != nil {
+			return fmt.Errorf("failed to declare RabbitMQ queue: %w", err)
+		}
+		pc.declared[queueName] = true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.confirmTimeout)
+	defer cancel()
+
+	confirm, err := pc.ch.PublishWithDeferredConfirmWithContext(
+		ctx,
+		"",        // Exchange
+		queueName, // Routing key
+		false,     // Mandatory
+		false,     // Immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Body:         body,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to publish message to RabbitMQ: %w", err)
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("no publisher confirm from RabbitMQ: %w", err)
+	}
+	if !acked {
+		return errors.New("RabbitMQ rejected the message")
+	}
+	return nil
+}
+
+// acquire hands out an idle channel or opens a new one in confirm mode.
+func (p *PooledPublisher) acquire() (*pooledChannel, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, errors.New("publisher is closed")
+	}
+
+	for len(p.idle) > 0 {
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if !pc.ch.IsClosed() {
+			return pc, nil
+		}
+	}
+
+	conn, err := p.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open RabbitMQ channel: %w", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+	return &pooledChannel{ch: ch, declared: make(map[string]bool)}, nil
+}
+
+// release returns pc to the pool, closing it when the pool is full.
+func (p *PooledPublisher) release(pc *pooledChannel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || len(p.idle) >= p.poolSize || pc.ch.IsClosed() {
+		pc.ch.Close()
+		return
+	}
+	p.idle = append(p.idle, pc)
+}
+
+// connection returns the open connection, dialing a new one if needed. The
+// caller must hold p.mu.
+func (p *PooledPublisher) connection() (*amqp.Connection, error) {
+	if p.conn != nil && !p.conn.IsClosed() {
+		return p.conn, nil
+	}
+
+	conn, err := amqp.Dial(p.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	}
+	p.conn = conn
+	p.idle = nil
+
+	go p.watch(conn)
+	return conn, nil
+}
+
+// watch waits for conn to close and reconnects in the background unless the
+// publisher itself closed it.
+func (p *PooledPublisher) watch(conn *amqp.Connection) {
+	reason, ok := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+	if !ok || reason == nil {
+		return
+	}
+	log.Errorf("RabbitMQ connection closed : %v", reason)
+
+	backoff := reconnectMinBackoff
+	for {
+		p.mu.Lock()
+		if p.closed || p.conn != conn {
+			// Closed, or a publish already dialed a replacement
+			p.mu.Unlock()
+			return
+		}
+		_, err := p.connection()
+		p.mu.Unlock()
+		if err == nil {
+			log.Printf("Reconnected to RabbitMQ")
+			return
+		}
+
+		log.Errorf("Error reconnecting to RabbitMQ, retrying in %s : %v", backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+}
+
+// Close closes every pooled channel and the connection.
+func (p *PooledPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, pc := range p.idle {
+		pc.ch.Close()
+	}
+	p.idle = nil
+
+	if p.conn == nil {
+		return nil
+	}
+	return p.conn.Close()
+}
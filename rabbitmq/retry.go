@@ -0,0 +1,97 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// HeaderRetryCount counts how often a message has been sent back for retry.
+const HeaderRetryCount = "x-retry-count"
+
+// RetryQueueName returns the delay queue that holds messages of queueName for
+// delay before handing them back.
+func RetryQueueName(queueName string, delay time.Duration) string {
+	return queueName + ".retry." + delay.String()
+}
+
+// DeclareRetryQueues declares one delay queue per entry of delays. A message
+// waits out the queue's TTL and is then dead-lettered back onto queueName
+// through the default exchange. Each delay gets its own queue so a long wait
+// never holds up a short one.
+func DeclareRetryQueues(ch *amqp.Channel, queueName string, delays []time.Duration) error {
+	for _, delay := range delays {
+		_, err := ch.QueueDeclare(
+			RetryQueueName(queueName, delay), // Queue name
+			true,                             // Durable
+			false,                            // Delete when unused
+			false,                            // Exclusive
+			false,                            // No-wait
+			amqp.Table{
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queueName,
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare retry queue for %s: %w", delay, err)
+		}
+	}
+	return nil
+}
+
+// RetryCount returns how often d has already been retried.
+func RetryCount(d amqp.Delivery) int {
+	switch count := d.Headers[HeaderRetryCount].(type) {
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	case int:
+		return count
+	}
+	return 0
+}
+
+// Retry parks a copy of d in the delay queue for queueName and delay with its
+// retry count raised by one. The caller acks d once Retry succeeded.
+func Retry(ch *amqp.Channel, queueName string, delay time.Duration, d amqp.Delivery) error {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[HeaderRetryCount] = int32(RetryCount(d) + 1)
+
+	return publishConfirmed(ch, "", RetryQueueName(queueName, delay), amqp.Publishing{
+		Headers:      headers,
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		Body:         d.Body,
+	})
+}
+
+// publishConfirmed publishes msg and, when ch is in confirm mode, waits for the
+// broker to ack it.
+func publishConfirmed(ch *amqp.Channel, exchange, key string, msg amqp.Publishing) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, msg)
+	if err != nil {
+		return fmt.Errorf("failed to publish message to RabbitMQ: %w", err)
+	}
+	if confirm == nil {
+		return nil
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("no publisher confirm from RabbitMQ: %w", err)
+	}
+	if !acked {
+		return fmt.Errorf("RabbitMQ rejected the message for %q", key)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package rabbitmq
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// PlansQueue carries plan changes from the API to the indexer.
+	PlansQueue = "plans_queue"
+
+	// DeadLetterExchange receives messages a consumer gave up on. Each work
+	// queue has a "<queue>.dead" queue bound to it under the queue's name.
+	DeadLetterExchange = "plans.dlx"
+
+	// Headers set on a dead-lettered or quarantined message.
+	HeaderFailureReason = "x-failure-reason"
+	HeaderFailedAt      = "x-failed-at"
+	HeaderOriginalQueue = "x-original-queue"
+	HeaderAttempts      = "x-attempts"
+)
+
+// DeadLetterQueueName returns the queue dead letters of queueName are parked in.
+func DeadLetterQueueName(queueName string) string {
+	return queueName + ".dead"
+}
+
+// QuarantineQueueName returns the queue poison messages of queueName are
+// parked in. Unlike dead letters they failed in a way no retry can fix.
+func QuarantineQueueName(queueName string) string {
+	return queueName + ".quarantine"
+}
+
+// DeclareQueue declares the durable topology for queueName: the dead-letter
+// exchange, the queue's dead-letter and quarantine queues and the queue
+// itself, which dead-letters into the exchange. Publishers and consumers both call it so the
+// arguments always match.
+func DeclareQueue(ch *amqp.Channel, queueName string) (amqp.Queue, error) {
+	err := ch.ExchangeDeclare(
+		DeadLetterExchange, // Name
+		"direct",           // Kind
+		true,               // Durable
+		false,              // Auto-deleted
+		false,              // Internal
+		false,              // No-wait
+		nil,                // Arguments
+	)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	deadLetterQueue, err := ch.QueueDeclare(
+		DeadLetterQueueName(queueName), // Queue name
+		true,                           // Durable
+		false,                          // Delete when unused
+		false,                          // Exclusive
+		false,                          // No-wait
+		nil,                            // Arguments
+	)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	err = ch.QueueBind(
+		deadLetterQueue.Name, // Queue name
+		queueName,            // Routing key
+		DeadLetterExchange,   // Exchange
+		false,                // No-wait
+		nil,                  // Arguments
+	)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	_, err = ch.QueueDeclare(
+		QuarantineQueueName(queueName), // Queue name
+		true,                           // Durable
+		false,                          // Delete when unused
+		false,                          // Exclusive
+		false,                          // No-wait
+		nil,                            // Arguments
+	)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	return ch.QueueDeclare(
+		queueName, // Queue name
+		true,      // Durable
+		false,     // Delete when unused
+		false,     // Exclusive
+		false,     // No-wait
+		amqp.Table{
+			"x-dead-letter-exchange":    DeadLetterExchange,
+			"x-dead-letter-routing-key": queueName,
+		},
+	)
+}
@@ -0,0 +1,258 @@
+// Reindex moves the plans data into a new versioned index
+// without downtime:
+//
+//  1. create the next plans_vN index with the current mapping
+//  2. point the write alias at it, so live changes land there from now on
+//  3. backfill it from Redis (or the old index with -from=es)
+//  4. wait for plans_queue to drain, so queued changes are applied too
+//  5. swap the read alias over in one atomic step
+//
+// Running it again after an interruption resumes with the index the write
+// alias already points at.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"info7255-bigdata-app/database"
+	"info7255-bigdata-app/elastic"
+	"info7255-bigdata-app/rabbitmq"
+	"info7255-bigdata-app/services"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/gin-gonic/gin"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// batchSize is how many documents go into one _bulk request of the backfill.
+const batchSize = 500
+
+func main() {
+	from := flag.String("from", "redis", "where to backfill from: redis or es")
+	deleteOld := flag.Bool("delete-old", false, "delete the previous index after the swap")
+	drainTimeout := flag.Duration("drain-timeout", 5*time.Minute, "how long to wait for plans_queue to drain")
+	settle := flag.Duration("settle", 5*time.Second, "wait after the queue drained for the consumer to flush")
+	consumerMetrics := flag.String("consumer-metrics", "http://localhost:9102/debug/vars", "where the consumer serves its expvar metrics")
+	flag.Parse()
+
+	if *from != "redis" && *from != "es" {
+		log.Fatalf("-from must be redis or es, got %q", *from)
+	}
+
+	es, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{
+			"http://localhost:9200",
+		},
+	})
+	failOnError(err, "Failed to create the Elasticsearch client")
+
+	// An index behind the current mapping is what this command moves away
+	// from, so only the consumer refuses to write to it
+	err = elastic.EnsureAliases(es)
+	var versionErr *elastic.MappingVersionError
+	if errors.As(err, &versionErr) {
+		log.Printf("Moving the data off %s: %s", versionErr.Index, err)
+		err = nil
+	}
+	failOnError(err, "Failed to bootstrap the index")
+
+	readIndex, err := elastic.AliasTarget(es, elastic.IndexName)
+	failOnError(err, "Failed to read the read alias")
+	writeIndex, err := elastic.AliasTarget(es, elastic.WriteAlias)
+	failOnError(err, "Failed to read the write alias")
+
+	target := writeIndex
+	if writeIndex == readIndex {
+		next := elastic.IndexVersion(writeIndex) + 1
+		if next < elastic.MappingVersion {
+			next = elastic.MappingVersion
+		}
+		target = elastic.VersionedIndex(next)
+		err = elastic.CreateIndex(es, target, elastic.Mapping())
+		failOnError(err, "Failed to create "+target)
+
+		// Live changes go to the new index from here on
+		err = elastic.UpdateAliases(es,
+			elastic.RemoveAlias(writeIndex, elastic.WriteAlias),
+			elastic.AddAlias(target, elastic.WriteAlias),
+		)
+		failOnError(err, "Failed to move the write alias")
+		log.Printf("Writing to %s, still reading from %s", target, readIndex)
+	} else {
+		if elastic.IndexVersion(target) < elastic.MappingVersion {
+			log.Fatalf("%s is being reindexed into %s, which is behind mapping version %d; finish that reindex first", readIndex, target, elastic.MappingVersion)
+		}
+		log.Printf("Resuming the reindex of %s into %s", readIndex, target)
+	}
+
+	if *from == "es" {
+		err = elastic.Reindex(es, readIndex, target)
+	} else {
+		err = backfillFromRedis(es, target)
+	}
+	failOnError(err, "Failed to backfill "+target)
+
+	err = waitForQueue(*drainTimeout, *consumerMetrics)
+	failOnError(err, "Failed to catch up on queued changes")
+	time.Sleep(*settle)
+
+	err = elastic.UpdateAliases(es,
+		elastic.RemoveAlias(readIndex, elastic.IndexName),
+		elastic.AddAlias(target, elastic.IndexName),
+	)
+	failOnError(err, "Failed to swap the read alias")
+	log.Printf("Reading from %s", target)
+
+	if *deleteOld {
+		res, err := es.Indices.Delete([]string{readIndex})
+		failOnError(err, "Failed to delete "+readIndex)
+		res.Body.Close()
+		if res.IsError() {
+			log.Fatalf("Failed to delete %s: %s", readIndex, res.String())
+		}
+		log.Printf("Deleted %s", readIndex)
+	}
+}
+
+// backfillFromRedis indexes every plan graph stored in Redis into index.
+func backfillFromRedis(es *elasticsearch.Client, index string) error {
+	redisRepo := database.NewRedisRepository("localhost:6379")
+
+	bundled, err := services.LoadBundledSchemas("data")
+	if err != nil {
+		return err
+	}
+	schemaService := services.NewSchemaService(redisRepo, bundled)
+	documentStore := services.NewDocumentStore(redisRepo)
+	// The command only reads plans, so nothing is ever put in the outbox
+	planService := services.NewPlanService(redisRepo, documentStore, schemaService, nil, nil)
+
+	// Plans are read through the current key layout
+	if err := documentStore.Migrate(&gin.Context{}); err != nil {
+		return err
+	}
+	ids, err := planService.ListPlanIds(&gin.Context{})
+	if err != nil {
+		return err
+	}
+
+	batch := make([]elastic.Document, 0, batchSize)
+	indexed := 0
+	for _, id := range ids {
+		// Written with the versions it was read at, a plan deleted since is
+		// not brought back: the delete went to index with a higher version
+		plan, versions, err := planService.GetVersioned(&gin.Context{}, id)
+		if err != nil {
+			if err.Error() == "KEY_NOT_FOUND" {
+				continue
+			}
+			return err
+		}
+		documents, err := elastic.Documents(plan)
+		if err != nil {
+			log.Printf("Skipping plan %v: %s", plan["objectId"], err)
+			continue
+		}
+		for i := range documents {
+			documents[i].Version = versions[documents[i].ObjectId]
+		}
+		batch = append(batch, documents...)
+		indexed++
+
+		if len(batch) >= batchSize {
+			if err := elastic.BulkCreate(es, index, batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+			log.Printf("Backfilled %d of %d plans", indexed, len(ids))
+		}
+	}
+	if err := elastic.BulkCreate(es, index, batch); err != nil {
+		return err
+	}
+
+	log.Printf("Backfilled %d of %d plans into %s", indexed, len(ids), index)
+	return nil
+}
+
+// consumerVars is the part of the consumer's expvar output the drain check
+// reads.
+type consumerVars struct {
+	InFlight    int64    `json:"consumer_in_flight"`
+	RetryQueues []string `json:"consumer_retry_queues"`
+}
+
+// readConsumerVars fetches the consumer's metrics from metricsURL.
+func readConsumerVars(metricsURL string) (consumerVars, error) {
+	var vars consumerVars
+	res, err := http.Get(metricsURL)
+	if err != nil {
+		return vars, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return vars, fmt.Errorf("%s answered %s", metricsURL, res.Status)
+	}
+	err = json.NewDecoder(res.Body).Decode(&vars)
+	return vars, err
+}
+
+// waitForQueue polls until plans_queue holds no message, the consumer has
+// settled every message it received and its retry queues are empty, or
+// timeout passes. The consumer's state is read from metricsURL, since the
+// broker does not report unacknowledged messages over AMQP.
+func waitForQueue(timeout time.Duration, metricsURL string) error {
+	conn, err := amqp.Dial(rabbitmq.DefaultURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		queue, err := rabbitmq.DeclareQueue(ch, rabbitmq.PlansQueue)
+		if err != nil {
+			return err
+		}
+		vars, err := readConsumerVars(metricsURL)
+		if err != nil {
+			return fmt.Errorf("reading the consumer metrics: %w", err)
+		}
+		retrying := 0
+		for _, name := range vars.RetryQueues {
+			retryQueue, err := ch.QueueDeclarePassive(name, true, false, false, false, nil)
+			if err != nil {
+				return err
+			}
+			retrying += retryQueue.Messages
+		}
+
+		if queue.Messages == 0 && vars.InFlight == 0 && retrying == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s still holds %d messages, %d are unacknowledged and %d wait for a retry; run the command again to resume",
+				queue.Name, queue.Messages, vars.InFlight, retrying)
+		}
+
+		log.Printf("Waiting for %d queued, %d unacknowledged and %d retried messages", queue.Messages, vars.InFlight, retrying)
+		time.Sleep(time.Second)
+	}
+}
+
+func failOnError(err error, msg string) {
+	if err != nil {
+		log.Fatalf("%s: %s", msg, err)
+	}
+}
@@ -1,13 +1,56 @@
 package repositories
 
 import (
-	"github.com/gin-gonic/gin"
+	"context"
+	"time"
 )
 
 type RedisRepo interface {
-	Ping(ctx *gin.Context) error
-	Get(ctx *gin.Context, key string) (string, error)
-	Set(ctx *gin.Context, key, value string) error
-	Delete(ctx *gin.Context, key string) error
-	Keys(ctx *gin.Context, pattern string) ([]string, error)
+	Ping(ctx context.Context) error
+	Get(ctx context.Context, key string) (string, error)
+	Set(ctx context.Context, key, value string) error
+	Delete(ctx context.Context, key string) error
+	Keys(ctx context.Context, pattern string) ([]string, error)
+	Incr(ctx context.Context, key string) (int64, error)
+	SAdd(ctx context.Context, key string, members ...string) error
+	SMembers(ctx context.Context, key string) ([]string, error)
+	LRange(ctx context.Context, key string, start, stop int64) ([]string, error)
+	// ZRangeByLex returns up to count members of a sorted set written with
+	// RedisTx.ZAdd, from min to max in lexicographic order. Bounds use the
+	// Redis syntax: "-", "+", "[member" or "(member".
+	ZRangeByLex(ctx context.Context, key, min, max string, count int64) ([]string, error)
+	// ZRevRangeByLex is ZRangeByLex in descending order, from max to min.
+	ZRevRangeByLex(ctx context.Context, key, max, min string, count int64) ([]string, error)
+	// SubscribeExpired calls fn with the name of every key that expires until
+	// ctx is done or the subscription fails.
+	SubscribeExpired(ctx context.Context, fn func(key string)) error
+	// Batch queues the writes made by fn and applies them as one transaction.
+	// Nothing is written when fn returns an error.
+	Batch(ctx context.Context, fn func(tx RedisTx) error) error
+	// Watch is Batch with optimistic locking. fn passes the keys it is
+	// about to read to watch first; its writes are only applied if none of
+	// the watched keys changed before the commit. Otherwise nothing is
+	// written and Watch fails with TX_CONFLICT.
+	Watch(ctx context.Context, fn func(watch func(keys ...string) error, tx RedisTx) error) error
+}
+
+// RedisTx collects writes for RedisRepo.Batch and RedisRepo.Watch. Reads go through the
+// repository itself and are not part of the transaction. Keys never expire
+// unless written with SetEx.
+type RedisTx interface {
+	Set(key, value string)
+	SetEx(key, value string, ttl time.Duration)
+	// Persist removes the expiry of key.
+	Persist(key string)
+	Delete(keys ...string)
+	SAdd(key string, members ...string)
+	SRem(key string, members ...string)
+	RPush(key string, values ...string)
+	// LRem removes every occurrence of value from the list.
+	LRem(key, value string)
+	LTrim(key string, start, stop int64)
+	// ZAdd adds members to a sorted set with score 0, so they sort
+	// lexicographically.
+	ZAdd(key string, members ...string)
+	ZRem(key string, members ...string)
 }
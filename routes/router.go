@@ -1,11 +1,17 @@
 package routes
 
 import (
+	"context"
 	"info7255-bigdata-app/database"
 	"info7255-bigdata-app/elastic"
 	"info7255-bigdata-app/handlers"
 	"info7255-bigdata-app/middleware"
+	"info7255-bigdata-app/rabbitmq"
 	"info7255-bigdata-app/services"
+	"log"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -17,19 +23,75 @@ func SetupRouter() *gin.Engine {
 	router.Use(gin.Recovery())
 
 	redisRepo := database.NewRedisRepository("localhost:6379")
-	planService := services.NewPlanService(redisRepo)
 	esFactory := elastic.NewElasticFactory()
-	planHandler := handlers.NewPlanHandler(planService, esFactory)
+
+	bundled, err := services.LoadBundledSchemas("data")
+	if err != nil {
+		log.Fatalf("Failed to load the bundled schemas: %v", err)
+	}
+	schemaService := services.NewSchemaService(redisRepo, bundled)
+	documentStore := services.NewDocumentStore(redisRepo)
+	publisher := rabbitmq.NewPublisher(rabbitmq.DefaultURL, 4, 5*time.Second)
+	outbox := services.NewOutbox(redisRepo, publisher)
+	retention, err := services.ParseRetentionPolicy(os.Getenv("RETENTION"))
+	if err != nil {
+		log.Fatalf("Invalid RETENTION: %v", err)
+	}
+	planService := services.NewPlanService(redisRepo, documentStore, schemaService, outbox, retention)
+	reindexService := services.NewReindexService(redisRepo, planService, outbox)
+	consistencyService := services.NewConsistencyService(redisRepo, planService, outbox, esFactory)
+
+	// Move objects stored by earlier versions to the current key layout
+	// before anything reads them
+	if err := documentStore.Migrate(&gin.Context{}); err != nil {
+		log.Fatalf("Failed to migrate the stored objects: %v", err)
+	}
+
+	// Relay committed plan messages to RabbitMQ for the lifetime of the process
+	go outbox.Run(context.Background())
+	// Delete plans whose retention ran out
+	go services.NewExpirer(redisRepo, planService, 10*time.Minute).Run(context.Background())
+
+	requireIfMatch := false
+	if value := os.Getenv("REQUIRE_IF_MATCH"); value != "" {
+		requireIfMatch, err = strconv.ParseBool(value)
+		if err != nil {
+			log.Fatalf("Invalid REQUIRE_IF_MATCH: %v", err)
+		}
+	}
+
+	planHandler := handlers.NewPlanHandler(planService, schemaService, esFactory, requireIfMatch)
+	schemaHandler := handlers.NewSchemaHandler(schemaService)
+	reindexHandler := handlers.NewReindexHandler(reindexService)
+	consistencyHandler := handlers.NewConsistencyHandler(consistencyService)
+	deadLetterHandler := handlers.NewDeadLetterHandler(rabbitmq.NewDeadLetters(rabbitmq.DefaultURL))
 
 	v1 := router.Group("/v1", middleware.OAuth2Middleware())
 	{
 		v1.POST("/plan", planHandler.CreatePlan)
 		v1.GET("/plan/:objectId", planHandler.GetPlan)
+		v1.HEAD("/plan/:objectId", planHandler.GetPlan)
+		v1.GET("/plan/:objectId/plans", planHandler.GetReferencingPlans)
 		v1.DELETE("/plan/:objectId", planHandler.DeletePlan)
 		v1.PATCH("/plan/:objectId", planHandler.PatchPlan)
 		v1.PUT("/plan", planHandler.UpdatePlan)
 		v1.GET("/plans", planHandler.GetAllPlans)
 		v1.POST("/search", planHandler.SearchPlans)
+
+		v1.GET("/schema", schemaHandler.ListSchemas)
+		v1.POST("/schema/:objectType", schemaHandler.CreateSchema)
+		v1.GET("/schema/:objectType", schemaHandler.GetActiveSchema)
+		v1.PUT("/schema/:objectType/active", schemaHandler.ActivateSchema)
+		v1.GET("/schema/:objectType/versions", schemaHandler.ListVersions)
+		v1.GET("/schema/:objectType/versions/:version", schemaHandler.GetSchemaVersion)
+
+		v1.GET("/deadletters", deadLetterHandler.ListDeadLetters)
+		v1.POST("/deadletters/replay", deadLetterHandler.ReplayDeadLetters)
+
+		v1.POST("/admin/reindex", reindexHandler.StartReindex)
+		v1.GET("/admin/reindex", reindexHandler.GetReindexStatus)
+		v1.GET("/admin/consistency", consistencyHandler.CheckConsistency)
+		v1.POST("/admin/consistency/repair", consistencyHandler.RepairConsistency)
 	}
 
 	return router
@@ -0,0 +1,549 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Schema is a parsed JSON Schema document (draft-07 subset) that can validate
+// decoded JSON values.
+type Schema struct {
+	root     map[string]interface{}
+	raw      []byte
+	patterns map[string]*regexp.Regexp
+}
+
+// Violation describes a single rule a document failed. Path is a JSON pointer
+// to the offending value inside the validated document.
+type Violation struct {
+	Path    string `json:"path"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidationError wraps every violation found while validating a document.
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		messages = append(messages, fmt.Sprintf("%s: %s", pathOrRoot(v.Path), v.Message))
+	}
+	return "schema validation failed: " + strings.Join(messages, "; ")
+}
+
+// LoadFile reads and parses the JSON Schema stored at path.
+func LoadFile(path string) (*Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema %s: %w", path, err)
+	}
+	return Parse(data)
+}
+
+// Parse parses a JSON Schema document and pre-compiles its patterns.
+func Parse(data []byte) (*Schema, error) {
+	var root map[string]interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("schema is not a JSON object: %w", err)
+	}
+
+	s := &Schema{
+		root:     root,
+		raw:      data,
+		patterns: make(map[string]*regexp.Regexp),
+	}
+	if err := s.compile(root); err != nil {
+		return nil, err
+	}
+	if err := s.checkRefCycles(root); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Raw returns the schema document exactly as it was parsed.
+func (s *Schema) Raw() []byte {
+	return s.raw
+}
+
+// ValidateJSON decodes data and validates it. A decoding failure is returned
+// as an error, rule failures as violations.
+func (s *Schema) ValidateJSON(data []byte) ([]Violation, error) {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return s.Validate(doc), nil
+}
+
+// Validate checks an already decoded JSON value and returns every violation,
+// ordered by path.
+func (s *Schema) Validate(doc interface{}) []Violation {
+	violations := s.validate(s.root, doc, "")
+	sort.SliceStable(violations, func(i, j int) bool {
+		return violations[i].Path < violations[j].Path
+	})
+	return violations
+}
+
+// ValidatePartial validates doc like Validate but does not enforce the
+// top-level "required" list. It is meant for partial updates, where nested
+// objects are still replaced whole and must be complete.
+func (s *Schema) ValidatePartial(doc interface{}) []Violation {
+	root := make(map[string]interface{}, len(s.root))
+	for k, v := range s.root {
+		if k != "required" {
+			root[k] = v
+		}
+	}
+
+	violations := s.validate(root, doc, "")
+	sort.SliceStable(violations, func(i, j int) bool {
+		return violations[i].Path < violations[j].Path
+	})
+	return violations
+}
+
+func (s *Schema) compile(node interface{}) error {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if pattern, ok := n["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+			s.patterns[pattern] = re
+		}
+		if ref, ok := n["$ref"].(string); ok {
+			if _, err := s.resolve(ref); err != nil {
+				return err
+			}
+		}
+		for _, child := range n {
+			if err := s.compile(child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range n {
+			if err := s.compile(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkRefCycles rejects $ref chains that lead back to where they started
+// without descending into the validated value. Validating against one would
+// never end. Recursion through properties or items is fine, since every
+// step consumes part of the document.
+func (s *Schema) checkRefCycles(root map[string]interface{}) error {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+
+	var visit func(ref string) error
+	visit = func(ref string) error {
+		switch state[ref] {
+		case visiting:
+			return fmt.Errorf("$ref %q refers back to itself", ref)
+		case done:
+			return nil
+		}
+		state[ref] = visiting
+		target, err := s.resolve(ref)
+		if err != nil {
+			return err
+		}
+		for _, next := range sameValueRefs(target) {
+			if err := visit(next); err != nil {
+				return err
+			}
+		}
+		state[ref] = done
+		return nil
+	}
+
+	var walk func(node interface{}) error
+	walk = func(node interface{}) error {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			if ref, ok := n["$ref"].(string); ok {
+				if err := visit(ref); err != nil {
+					return err
+				}
+			}
+			for _, child := range n {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for _, child := range n {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(root)
+}
+
+// sameValueRefs returns the references node validates the same value
+// against: its own $ref, or those of its combinators.
+func sameValueRefs(node map[string]interface{}) []string {
+	if ref, ok := node["$ref"].(string); ok {
+		return []string{ref}
+	}
+
+	var refs []string
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		subs, _ := node[keyword].([]interface{})
+		for _, sub := range subs {
+			if subSchema, ok := sub.(map[string]interface{}); ok {
+				refs = append(refs, sameValueRefs(subSchema)...)
+			}
+		}
+	}
+	if not, ok := node["not"].(map[string]interface{}); ok {
+		refs = append(refs, sameValueRefs(not)...)
+	}
+	return refs
+}
+
+// resolve looks up a local reference such as "#/definitions/costShare".
+func (s *Schema) resolve(ref string) (map[string]interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported $ref %q: only local references are allowed", ref)
+	}
+
+	var current interface{} = s.root
+	for _, token := range splitPointer(strings.TrimPrefix(ref, "#")) {
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		if current, ok = obj[token]; !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+	}
+
+	node, ok := current.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("$ref %q does not point to a schema object", ref)
+	}
+	return node, nil
+}
+
+func (s *Schema) validate(node map[string]interface{}, value interface{}, path string) []Violation {
+	var violations []Violation
+	add := func(rule, format string, args ...interface{}) {
+		violations = append(violations, Violation{Path: path, Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if ref, ok := node["$ref"].(string); ok {
+		target, err := s.resolve(ref)
+		if err != nil {
+			add("$ref", "%v", err)
+			return violations
+		}
+		return s.validate(target, value, path)
+	}
+
+	if types, ok := node["type"]; ok && !matchesType(types, value) {
+		add("type", "expected %s but got %s", describeTypes(types), typeOf(value))
+		return violations
+	}
+
+	if enum, ok := node["enum"].([]interface{}); ok {
+		found := false
+		for _, candidate := range enum {
+			if equal(candidate, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			add("enum", "value must be one of %s", mustMarshal(enum))
+		}
+	}
+
+	if constant, ok := node["const"]; ok && !equal(constant, value) {
+		add("const", "value must be %s", mustMarshal(constant))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		violations = append(violations, s.validateObject(node, v, path)...)
+	case []interface{}:
+		violations = append(violations, s.validateArray(node, v, path)...)
+	case string:
+		violations = append(violations, s.validateString(node, v, path)...)
+	case float64:
+		violations = append(violations, validateNumber(node, v, path)...)
+	}
+
+	violations = append(violations, s.validateCombinators(node, value, path)...)
+	return violations
+}
+
+func (s *Schema) validateObject(node map[string]interface{}, obj map[string]interface{}, path string) []Violation {
+	var violations []Violation
+
+	if required, ok := node["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, present := obj[name]; !present {
+				violations = append(violations, Violation{
+					Path:    joinPointer(path, name),
+					Rule:    "required",
+					Message: fmt.Sprintf("property %q is required", name),
+				})
+			}
+		}
+	}
+
+	properties, _ := node["properties"].(map[string]interface{})
+	for name, value := range obj {
+		if propSchema, ok := properties[name].(map[string]interface{}); ok {
+			violations = append(violations, s.validate(propSchema, value, joinPointer(path, name))...)
+			continue
+		}
+
+		switch additional := node["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				violations = append(violations, Violation{
+					Path:    joinPointer(path, name),
+					Rule:    "additionalProperties",
+					Message: fmt.Sprintf("property %q is not allowed", name),
+				})
+			}
+		case map[string]interface{}:
+			violations = append(violations, s.validate(additional, value, joinPointer(path, name))...)
+		}
+	}
+
+	if min, ok := node["minProperties"].(float64); ok && float64(len(obj)) < min {
+		violations = append(violations, Violation{Path: path, Rule: "minProperties", Message: fmt.Sprintf("object must have at least %v properties", min)})
+	}
+	if max, ok := node["maxProperties"].(float64); ok && float64(len(obj)) > max {
+		violations = append(violations, Violation{Path: path, Rule: "maxProperties", Message: fmt.Sprintf("object must have at most %v properties", max)})
+	}
+
+	return violations
+}
+
+func (s *Schema) validateArray(node map[string]interface{}, arr []interface{}, path string) []Violation {
+	var violations []Violation
+
+	if min, ok := node["minItems"].(float64); ok && float64(len(arr)) < min {
+		violations = append(violations, Violation{Path: path, Rule: "minItems", Message: fmt.Sprintf("array must have at least %v items", min)})
+	}
+	if max, ok := node["maxItems"].(float64); ok && float64(len(arr)) > max {
+		violations = append(violations, Violation{Path: path, Rule: "maxItems", Message: fmt.Sprintf("array must have at most %v items", max)})
+	}
+
+	if unique, ok := node["uniqueItems"].(bool); ok && unique {
+		for i := 0; i < len(arr); i++ {
+			for j := i + 1; j < len(arr); j++ {
+				if equal(arr[i], arr[j]) {
+					violations = append(violations, Violation{Path: joinPointer(path, fmt.Sprint(j)), Rule: "uniqueItems", Message: fmt.Sprintf("item duplicates item %d", i)})
+				}
+			}
+		}
+	}
+
+	if items, ok := node["items"].(map[string]interface{}); ok {
+		for i, item := range arr {
+			violations = append(violations, s.validate(items, item, joinPointer(path, fmt.Sprint(i)))...)
+		}
+	}
+
+	return violations
+}
+
+func (s *Schema) validateString(node map[string]interface{}, str string, path string) []Violation {
+	var violations []Violation
+	length := float64(len([]rune(str)))
+
+	if min, ok := node["minLength"].(float64); ok && length < min {
+		violations = append(violations, Violation{Path: path, Rule: "minLength", Message: fmt.Sprintf("string must be at least %v characters long", min)})
+	}
+	if max, ok := node["maxLength"].(float64); ok && length > max {
+		violations = append(violations, Violation{Path: path, Rule: "maxLength", Message: fmt.Sprintf("string must be at most %v characters long", max)})
+	}
+	if pattern, ok := node["pattern"].(string); ok && !s.patterns[pattern].MatchString(str) {
+		violations = append(violations, Violation{Path: path, Rule: "pattern", Message: fmt.Sprintf("string must match pattern %q", pattern)})
+	}
+
+	return violations
+}
+
+func validateNumber(node map[string]interface{}, num float64, path string) []Violation {
+	var violations []Violation
+
+	if min, ok := node["minimum"].(float64); ok && num < min {
+		violations = append(violations, Violation{Path: path, Rule: "minimum", Message: fmt.Sprintf("value must be >= %v", min)})
+	}
+	if max, ok := node["maximum"].(float64); ok && num > max {
+		violations = append(violations, Violation{Path: path, Rule: "maximum", Message: fmt.Sprintf("value must be <= %v", max)})
+	}
+	if min, ok := node["exclusiveMinimum"].(float64); ok && num <= min {
+		violations = append(violations, Violation{Path: path, Rule: "exclusiveMinimum", Message: fmt.Sprintf("value must be > %v", min)})
+	}
+	if max, ok := node["exclusiveMaximum"].(float64); ok && num >= max {
+		violations = append(violations, Violation{Path: path, Rule: "exclusiveMaximum", Message: fmt.Sprintf("value must be < %v", max)})
+	}
+	if multiple, ok := node["multipleOf"].(float64); ok && multiple > 0 {
+		if q := num / multiple; q != float64(int64(q)) {
+			violations = append(violations, Violation{Path: path, Rule: "multipleOf", Message: fmt.Sprintf("value must be a multiple of %v", multiple)})
+		}
+	}
+
+	return violations
+}
+
+func (s *Schema) validateCombinators(node map[string]interface{}, value interface{}, path string) []Violation {
+	var violations []Violation
+
+	if allOf, ok := node["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			if subSchema, ok := sub.(map[string]interface{}); ok {
+				violations = append(violations, s.validate(subSchema, value, path)...)
+			}
+		}
+	}
+
+	if anyOf, ok := node["anyOf"].([]interface{}); ok && s.countMatches(anyOf, value, path) == 0 {
+		violations = append(violations, Violation{Path: path, Rule: "anyOf", Message: "value must match at least one of the allowed schemas"})
+	}
+
+	if oneOf, ok := node["oneOf"].([]interface{}); ok {
+		if matches := s.countMatches(oneOf, value, path); matches != 1 {
+			violations = append(violations, Violation{Path: path, Rule: "oneOf", Message: fmt.Sprintf("value must match exactly one schema but matched %d", matches)})
+		}
+	}
+
+	if not, ok := node["not"].(map[string]interface{}); ok && len(s.validate(not, value, path)) == 0 {
+		violations = append(violations, Violation{Path: path, Rule: "not", Message: "value must not match the disallowed schema"})
+	}
+
+	return violations
+}
+
+func (s *Schema) countMatches(schemas []interface{}, value interface{}, path string) int {
+	matches := 0
+	for _, sub := range schemas {
+		if subSchema, ok := sub.(map[string]interface{}); ok && len(s.validate(subSchema, value, path)) == 0 {
+			matches++
+		}
+	}
+	return matches
+}
+
+func matchesType(types interface{}, value interface{}) bool {
+	switch t := types.(type) {
+	case string:
+		return matchesSingleType(t, value)
+	case []interface{}:
+		for _, candidate := range t {
+			if name, ok := candidate.(string); ok && matchesSingleType(name, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchesSingleType(name string, value interface{}) bool {
+	switch name {
+	case "integer":
+		num, ok := value.(float64)
+		return ok && num == float64(int64(num))
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	default:
+		return typeOf(value) == name
+	}
+}
+
+func typeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func describeTypes(types interface{}) string {
+	if list, ok := types.([]interface{}); ok {
+		names := make([]string, 0, len(list))
+		for _, t := range list {
+			names = append(names, fmt.Sprint(t))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(types)
+}
+
+func equal(a, b interface{}) bool {
+	return mustMarshal(a) == mustMarshal(b)
+}
+
+func mustMarshal(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+func joinPointer(path, token string) string {
+	token = strings.ReplaceAll(token, "~", "~0")
+	token = strings.ReplaceAll(token, "/", "~1")
+	return path + "/" + token
+}
+
+func splitPointer(pointer string) []string {
+	if pointer == "" || pointer == "/" {
+		return nil
+	}
+	tokens := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, token := range tokens {
+		token = strings.ReplaceAll(token, "~1", "/")
+		tokens[i] = strings.ReplaceAll(token, "~0", "~")
+	}
+	return tokens
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
@@ -0,0 +1,147 @@
+package schema
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+const testSchema = `{
+  "type": "object",
+  "definitions": {
+    "costShare": {
+      "type": "object",
+      "properties": {
+        "copay": { "type": "integer", "minimum": 0 },
+        "objectType": { "const": "membercostshare" }
+      },
+      "required": ["copay", "objectType"]
+    }
+  },
+  "properties": {
+    "objectId": { "type": "string", "minLength": 1 },
+    "creationDate": { "type": "string", "pattern": "^[0-9]{2}-[0-9]{2}-[0-9]{4}$" },
+    "planCostShares": { "$ref": "#/definitions/costShare" },
+    "tags": { "type": "array", "items": { "type": "string" }, "uniqueItems": true }
+  },
+  "required": ["objectId", "planCostShares"],
+  "additionalProperties": false
+}`
+
+func mustParse(t *testing.T, data string) *Schema {
+	t.Helper()
+	s, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return s
+}
+
+func TestValidate(t *testing.T) {
+	s := mustParse(t, testSchema)
+
+	tests := []struct {
+		name string
+		doc  string
+		want []Violation
+	}{
+		{
+			name: "valid",
+			doc:  `{"objectId": "1", "creationDate": "12-12-2017", "planCostShares": {"copay": 23, "objectType": "membercostshare"}, "tags": ["a", "b"]}`,
+		},
+		{
+			name: "required",
+			doc:  `{"planCostShares": {"copay": 23, "objectType": "membercostshare"}}`,
+			want: []Violation{{Path: "/objectId", Rule: "required", Message: `property "objectId" is required`}},
+		},
+		{
+			name: "through a $ref",
+			doc:  `{"objectId": "1", "planCostShares": {"copay": -1, "objectType": "service"}}`,
+			want: []Violation{
+				{Path: "/planCostShares/copay", Rule: "minimum", Message: "value must be >= 0"},
+				{Path: "/planCostShares/objectType", Rule: "const", Message: `value must be "membercostshare"`},
+			},
+		},
+		{
+			name: "pattern",
+			doc:  `{"objectId": "1", "creationDate": "2017-12-12", "planCostShares": {"copay": 0, "objectType": "membercostshare"}}`,
+			want: []Violation{{Path: "/creationDate", Rule: "pattern", Message: `string must match pattern "^[0-9]{2}-[0-9]{2}-[0-9]{4}$"`}},
+		},
+		{
+			name: "additional property and duplicate item",
+			doc:  `{"objectId": "1", "planCostShares": {"copay": 0, "objectType": "membercostshare"}, "tags": ["a", "a"], "extra": true}`,
+			want: []Violation{
+				{Path: "/extra", Rule: "additionalProperties", Message: `property "extra" is not allowed`},
+				{Path: "/tags/1", Rule: "uniqueItems", Message: "item duplicates item 0"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.ValidateJSON([]byte(tt.doc))
+			if err != nil {
+				t.Fatalf("ValidateJSON: %v", err)
+			}
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("violations = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePartial(t *testing.T) {
+	s := mustParse(t, testSchema)
+
+	if got := s.ValidatePartial(map[string]interface{}{"creationDate": "12-12-2017"}); len(got) != 0 {
+		t.Errorf("ValidatePartial enforced the top-level required list: %+v", got)
+	}
+
+	// Nested objects are replaced whole, so they must still be complete
+	got := s.ValidatePartial(map[string]interface{}{"planCostShares": map[string]interface{}{"copay": 1.0}})
+	want := []Violation{{Path: "/planCostShares/objectType", Rule: "required", Message: `property "objectType" is required`}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ValidatePartial = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseRejectsBadSchemas(t *testing.T) {
+	for name, data := range map[string]string{
+		"not an object":   `[]`,
+		"bad pattern":     `{"properties": {"a": {"type": "string", "pattern": "("}}}`,
+		"unresolved $ref": `{"properties": {"a": {"$ref": "#/definitions/missing"}}}`,
+		"$ref to itself":  `{"definitions": {"a": {"$ref": "#/definitions/a"}}, "properties": {"a": {"$ref": "#/definitions/a"}}}`,
+		"$ref cycle":      `{"definitions": {"a": {"$ref": "#/definitions/b"}, "b": {"anyOf": [{"$ref": "#/definitions/a"}]}}}`,
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("Parse accepted the schema with %s", name)
+		}
+	}
+
+	// Recursion that descends into the document ends
+	recursive := `{"definitions": {"node": {"type": "object", "properties": {"child": {"$ref": "#/definitions/node"}}}}, "$ref": "#/definitions/node"}`
+	s := mustParse(t, recursive)
+	if got := s.Validate(map[string]interface{}{"child": map[string]interface{}{"child": "leaf"}}); len(got) != 1 || got[0].Path != "/child/child" {
+		t.Errorf("Validate of the recursive schema = %+v, want one violation at /child/child", got)
+	}
+}
+
+func TestPlanSchemaAcceptsTheSamplePlan(t *testing.T) {
+	s, err := LoadFile("../data/plan-schema.json")
+	if err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+	data, err := os.ReadFile("../data/plan.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	violations, err := s.ValidateJSON(data)
+	if err != nil {
+		t.Fatalf("ValidateJSON: %v", err)
+	}
+	if len(violations) > 0 {
+		t.Errorf("the sample plan fails the plan schema: %+v", violations)
+	}
+}
@@ -0,0 +1,286 @@
+package services
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"info7255-bigdata-app/elastic"
+	"info7255-bigdata-app/models"
+	"info7255-bigdata-app/rabbitmq"
+	"info7255-bigdata-app/repositories"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/gin-gonic/gin"
+)
+
+// ConsistencyService compares the plan graphs in Redis, the source of truth,
+// with the plan_join documents in the search index.
+type ConsistencyService interface {
+	// Check reports every document that is missing, stale or orphaned. With
+	// repair set it also queues the messages that bring the index back in
+	// line: a create for each plan with a missing or stale document and a
+	// delete of every orphan.
+	Check(c *gin.Context, repair bool) (models.ConsistencyReport, error)
+}
+
+type consistencyService struct {
+	repo      repositories.RedisRepo
+	plans     PlanService
+	outbox    Outbox
+	esFactory *elastic.Factory
+}
+
+func NewConsistencyService(repo repositories.RedisRepo, plans PlanService, outbox Outbox, esFactory *elastic.Factory) ConsistencyService {
+	return &consistencyService{
+		repo:      repo,
+		plans:     plans,
+		outbox:    outbox,
+		esFactory: esFactory,
+	}
+}
+
+// expectedDocument is what Redis says one index document should hold. They
+// are keyed by document id, which tells apart the documents an object shared
+// by several plans has in each of them.
+type expectedDocument struct {
+	objectId string
+	routing  string
+	hash     string
+	planId   string
+}
+
+func (cs *consistencyService) Check(c *gin.Context, repair bool) (models.ConsistencyReport, error) {
+	report := models.ConsistencyReport{
+		CheckedAt: time.Now().UTC().Format(time.RFC3339),
+		Issues:    make([]models.ConsistencyIssue, 0),
+	}
+
+	// What Redis says the index should hold
+	ids, err := cs.plans.ListPlanIds(c)
+	if err != nil {
+		return report, err
+	}
+	plans := make(map[string]map[string]interface{}, len(ids))
+	expected := make(map[string]expectedDocument)
+	for _, id := range ids {
+		plan, err := cs.plans.GetAnyObject(c, id)
+		if err != nil {
+			if err.Error() == "KEY_NOT_FOUND" {
+				continue
+			}
+			return report, err
+		}
+		documents, err := elastic.Documents(plan)
+		if err != nil {
+			log.Printf("Skipping plan %s that cannot be indexed : %v", id, err)
+			continue
+		}
+		plans[id] = plan
+		for _, document := range documents {
+			expected[document.ID] = expectedDocument{
+				objectId: document.ObjectId,
+				routing:  document.Routing,
+				hash:     contentHash(document.Source),
+				planId:   id,
+			}
+		}
+	}
+	report.Plans = len(plans)
+	report.Expected = len(expected)
+
+	// What the index actually holds
+	client, err := cs.esFactory.NewClient(elasticsearch.Config{
+		Addresses: []string{
+			"http://localhost:9200",
+		},
+	})
+	if err != nil {
+		return report, err
+	}
+
+	seen := make(map[string]bool, len(expected))
+	err = elastic.Scan(client.ES, elastic.IndexName, func(document elastic.Document) error {
+		report.Indexed++
+		want, ok := expected[document.ID]
+		if !ok {
+			objectId := document.ObjectId
+			if objectId == "" {
+				objectId = document.ID
+			}
+			report.Issues = append(report.Issues, models.ConsistencyIssue{
+				Kind:       "orphaned",
+				ObjectId:   objectId,
+				DocumentId: document.ID,
+				Routing:    document.Routing,
+			})
+			return nil
+		}
+
+		seen[document.ID] = true
+		if want.hash != contentHash(document.Source) || want.routing != document.Routing {
+			report.Issues = append(report.Issues, models.ConsistencyIssue{
+				Kind:       "stale",
+				ObjectId:   want.objectId,
+				DocumentId: document.ID,
+				Routing:    document.Routing,
+				PlanId:     want.planId,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error scanning the search index : %v", err)
+		return report, err
+	}
+
+	for id, want := range expected {
+		if !seen[id] {
+			report.Issues = append(report.Issues, models.ConsistencyIssue{
+				Kind:       "missing",
+				ObjectId:   want.objectId,
+				DocumentId: id,
+				Routing:    want.routing,
+				PlanId:     want.planId,
+			})
+		}
+	}
+
+	sort.Slice(report.Issues, func(i, j int) bool {
+		if report.Issues[i].Kind != report.Issues[j].Kind {
+			return report.Issues[i].Kind < report.Issues[j].Kind
+		}
+		if report.Issues[i].ObjectId != report.Issues[j].ObjectId {
+			return report.Issues[i].ObjectId < report.Issues[j].ObjectId
+		}
+		return report.Issues[i].DocumentId < report.Issues[j].DocumentId
+	})
+	for _, issue := range report.Issues {
+		switch issue.Kind {
+		case "missing":
+			report.Missing++
+		case "stale":
+			report.Stale++
+		case "orphaned":
+			report.Orphaned++
+		}
+	}
+
+	if repair && len(report.Issues) > 0 {
+		result, err := cs.repair(c, report.Issues)
+		if err != nil {
+			return report, err
+		}
+		report.Repair = &result
+	}
+	return report, nil
+}
+
+// repair queues one create per affected plan and a single delete carrying
+// every orphan, all in one transaction.
+func (cs *consistencyService) repair(c *gin.Context, issues []models.ConsistencyIssue) (models.ConsistencyRepair, error) {
+	var result models.ConsistencyRepair
+	reindex := make(map[string]bool)
+	orphans := make([]models.IndexRef, 0)
+	for _, issue := range issues {
+		if issue.Kind == "orphaned" {
+			// Deleted by the id it was found under, which for documents
+			// indexed under an older layout is not the one it gets now
+			orphans = append(orphans, models.IndexRef{
+				ID:         issue.ObjectId,
+				Routing:    issue.Routing,
+				DocumentId: issue.DocumentId,
+			})
+			continue
+		}
+		reindex[issue.PlanId] = true
+	}
+
+	planIds := make([]string, 0, len(reindex))
+	for id := range reindex {
+		planIds = append(planIds, id)
+	}
+	sort.Strings(planIds)
+
+	// Plans are read again together with their versions, so a plan written
+	// or deleted since the check is indexed as it is now or not at all
+	current := make(map[string]map[string]interface{}, len(planIds))
+	versions := make(map[string]map[string]int64, len(planIds))
+	for _, id := range planIds {
+		plan, planVersions, err := cs.plans.GetVersioned(c, id)
+		if err != nil {
+			if err.Error() == "KEY_NOT_FOUND" {
+				continue
+			}
+			return result, err
+		}
+		current[id] = plan
+		versions[id] = planVersions
+	}
+	// An orphan is only deleted up to the version its object was last
+	// written at, so one stored since the check stays indexed
+	orphanVersions := make(map[string]int64, len(orphans))
+	for _, orphan := range orphans {
+		objectVersions, err := cs.plans.GraphVersions(c, orphan.ID)
+		if err != nil {
+			return result, err
+		}
+		if version := objectVersions[orphan.ID]; version > 0 {
+			orphanVersions[orphan.ID] = version
+		}
+	}
+
+	err := cs.repo.Batch(c, func(tx repositories.RedisTx) error {
+		for _, id := range planIds {
+			if current[id] == nil {
+				continue
+			}
+			err := cs.outbox.Enqueue(c, tx, rabbitmq.PlansQueue, models.PlanMessage{
+				Operation:   "create",
+				Plan:        current[id],
+				Versions:    versions[id],
+				CommittedAt: commitTime(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if len(orphans) == 0 {
+			return nil
+		}
+		return cs.outbox.Enqueue(c, tx, rabbitmq.PlansQueue, models.PlanMessage{
+			Operation:   "delete",
+			Removed:     orphans,
+			Versions:    orphanVersions,
+			CommittedAt: commitTime(),
+		})
+	})
+	if err != nil {
+		log.Printf("Error queueing the repair messages : %v", err)
+		return result, err
+	}
+	cs.outbox.Notify()
+
+	result.Reindexed = len(current)
+	result.Removed = len(orphans)
+	result.Messages = len(current)
+	if len(orphans) > 0 {
+		result.Messages++
+	}
+	log.Printf("Queued %d repair messages", result.Messages)
+	return result, nil
+}
+
+// contentHash fingerprints a document source. encoding/json writes map keys
+// in sorted order, so equal content always hashes the same.
+func contentHash(source map[string]interface{}) string {
+	data, err := json.Marshal(source)
+	if err != nil {
+		return ""
+	}
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
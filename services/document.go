@@ -0,0 +1,567 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"info7255-bigdata-app/graph"
+	"info7255-bigdata-app/repositories"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Object keys share the keyspace with these namespaces, so no objectType may
+// use one of their names.
+var reservedNamespaces = map[string]bool{
+	"id": true, "edges": true, "parents": true, "meta": true, "index": true,
+	"outbox": true, "schema": true, "reindex": true, "storage": true,
+	"version": true, "retention": true, "expires": true,
+}
+
+const (
+	// storageVersionKey records the layout Migrate last brought the data to.
+	storageVersionKey = "storage:version"
+	storageVersion    = 3
+	// migrateBatch is how many objects one transaction of Migrate moves.
+	migrateBatch = 500
+)
+
+// DocumentStore persists arbitrary JSON documents as a graph. Every nested
+// object carrying objectId and objectType is stored under
+// {objectType}:{objectId}, and id:{objectId} holds its objectType so it can
+// be found by id alone. edges:{objectId} holds the ids of its direct children
+// and parents:{objectId} the ids of the objects referencing it, so an object
+// can be shared by several plans. Writes are queued on a transaction so
+// callers can commit a whole graph, together with anything else they need to
+// store, as one unit.
+type DocumentStore interface {
+	// Save queues the whole graph rooted at doc. Objects the graph reached
+	// before that are no longer referenced by anything are removed, and
+	// their ids returned.
+	Save(c *gin.Context, tx repositories.RedisTx, doc map[string]interface{}) ([]graph.Node, []string, error)
+	// Load reassembles the document rooted at objectId.
+	Load(c *gin.Context, objectId string) (map[string]interface{}, error)
+	// Type returns the objectType of the stored object objectId.
+	Type(c *gin.Context, objectId string) (string, error)
+	// Delete queues the removal of objectId and of every descendant nothing
+	// else references, and returns their ids.
+	Delete(c *gin.Context, tx repositories.RedisTx, objectId string) ([]string, error)
+	// Reachable returns ids and the ids of every stored object below them,
+	// breadth first.
+	Reachable(c *gin.Context, ids []string) ([]string, error)
+	// Roots returns the ids of the top-level objects, i.e. plans, whose
+	// graph contains objectId, sorted.
+	Roots(c *gin.Context, objectId string) ([]string, error)
+	// Migrate moves objects stored by earlier versions, under their bare
+	// objectId, to the current layout and lists them in the listing sorted
+	// sets. Save and Delete keep everything current afterwards.
+	Migrate(c *gin.Context) error
+}
+
+type documentStore struct {
+	repo repositories.RedisRepo
+}
+
+func NewDocumentStore(repo repositories.RedisRepo) DocumentStore {
+	return &documentStore{
+		repo: repo,
+	}
+}
+
+// storedGraph is the stored part of the graph reachable from some objects.
+type storedGraph struct {
+	// order lists the objects breadth first.
+	order    []string
+	children map[string][]string
+	bodies   map[string]map[string]interface{}
+}
+
+func (g *storedGraph) contains(objectId string) bool {
+	_, ok := g.children[objectId]
+	return ok
+}
+
+func (ds *documentStore) Save(c *gin.Context, tx repositories.RedisTx, doc map[string]interface{}) ([]graph.Node, []string, error) {
+	nodes, err := graph.Split(doc)
+	if err != nil {
+		log.Printf("Error splitting the document into objects : %v", err)
+		return nil, nil, err
+	}
+
+	ids := make([]string, 0, len(nodes))
+	current := make(map[string]bool, len(nodes))
+	children := make(map[string]map[string]bool, len(nodes))
+	for _, node := range nodes {
+		if reservedNamespaces[node.ObjectType] {
+			return nil, nil, fmt.Errorf("objectType %q is reserved", node.ObjectType)
+		}
+		ids = append(ids, node.ObjectId)
+		current[node.ObjectId] = true
+		children[node.ObjectId] = make(map[string]bool)
+		if node.ParentId != "" {
+			children[node.ParentId][node.ObjectId] = true
+		}
+	}
+
+	// Everything the new objects reached before, including children they
+	// no longer have
+	stored, err := ds.walk(c, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	removed, err := ds.unreferenced(c, stored, current, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, node := range nodes {
+		if body, ok := stored.bodies[node.ObjectId]; ok {
+			if _, objectType, _ := graph.Identity(body); objectType != node.ObjectType {
+				tx.Delete(objectKey(objectType, node.ObjectId))
+			}
+		}
+
+		value, err := json.Marshal(node.Body)
+		if err != nil {
+			log.Errorf("Error marshalling the %s object : %v", node.ObjectType, err)
+			return nil, nil, err
+		}
+		tx.Set(objectKey(node.ObjectType, node.ObjectId), string(value))
+		tx.Set(idKey(node.ObjectId), node.ObjectType)
+		tx.Delete(edgesKey(node.ObjectId))
+
+		for _, child := range stored.children[node.ObjectId] {
+			if !children[node.ObjectId][child] {
+				tx.SRem(parentsKey(child), node.ObjectId)
+			}
+		}
+	}
+	for _, node := range nodes {
+		if node.ParentId != "" {
+			tx.SAdd(edgesKey(node.ParentId), node.ObjectId)
+			tx.SAdd(parentsKey(node.ObjectId), node.ParentId)
+		}
+	}
+
+	previous := make(map[string]map[string]interface{})
+	for _, id := range append(ids, removed...) {
+		if body, ok := stored.bodies[id]; ok {
+			previous[id] = body
+		}
+	}
+	for _, id := range removed {
+		drop(tx, stored, id)
+	}
+	index(tx, previous, nodes)
+
+	return nodes, removed, nil
+}
+
+func (ds *documentStore) Load(c *gin.Context, objectId string) (map[string]interface{}, error) {
+	return graph.Assemble(objectId, func(id string) (map[string]interface{}, error) {
+		objectType, err := ds.Type(c, id)
+		if err != nil {
+			return nil, err
+		}
+		value, err := ds.repo.Get(c, objectKey(objectType, id))
+		if err != nil {
+			return nil, err
+		}
+
+		var body map[string]interface{}
+		if err := json.Unmarshal([]byte(value), &body); err != nil {
+			log.Printf("Error unmarshalling object %s from redis : %v", id, err)
+			return nil, err
+		}
+		return body, nil
+	})
+}
+
+func (ds *documentStore) Type(c *gin.Context, objectId string) (string, error) {
+	return ds.repo.Get(c, idKey(objectId))
+}
+
+func (ds *documentStore) Delete(c *gin.Context, tx repositories.RedisTx, objectId string) ([]string, error) {
+	if _, err := ds.Type(c, objectId); err != nil {
+		return nil, err
+	}
+
+	stored, err := ds.walk(c, []string{objectId})
+	if err != nil {
+		return nil, err
+	}
+	removed, err := ds.unreferenced(c, stored, nil, objectId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Objects still referencing objectId lose the edge
+	parents, err := ds.repo.SMembers(c, parentsKey(objectId))
+	if err != nil {
+		log.Printf("Error reading the parents of %s from redis : %v", objectId, err)
+		return nil, err
+	}
+	for _, parent := range parents {
+		tx.SRem(edgesKey(parent), objectId)
+	}
+
+	previous := make(map[string]map[string]interface{}, len(removed))
+	for _, id := range removed {
+		drop(tx, stored, id)
+		if body, ok := stored.bodies[id]; ok {
+			previous[id] = body
+		}
+	}
+	unindex(tx, previous)
+	return removed, nil
+}
+
+func (ds *documentStore) Reachable(c *gin.Context, ids []string) ([]string, error) {
+	g, err := ds.reach(c, ids)
+	if err != nil {
+		return nil, err
+	}
+	return g.order, nil
+}
+
+func (ds *documentStore) Roots(c *gin.Context, objectId string) ([]string, error) {
+	if _, err := ds.Type(c, objectId); err != nil {
+		return nil, err
+	}
+
+	roots := make([]string, 0)
+	seen := map[string]bool{objectId: true}
+	queue := []string{objectId}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+
+		parents, err := ds.parents(c, id)
+		if err != nil {
+			return nil, err
+		}
+		if len(parents) == 0 {
+			roots = append(roots, id)
+			continue
+		}
+		for _, parent := range parents {
+			if !seen[parent] {
+				seen[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+	}
+
+	sort.Strings(roots)
+	return roots, nil
+}
+
+// parents returns the stored objects referencing objectId. Entries left
+// behind by objects that expired are skipped.
+func (ds *documentStore) parents(c *gin.Context, objectId string) ([]string, error) {
+	members, err := ds.repo.SMembers(c, parentsKey(objectId))
+	if err != nil {
+		log.Printf("Error reading the parents of %s from redis : %v", objectId, err)
+		return nil, err
+	}
+
+	parents := make([]string, 0, len(members))
+	for _, parent := range members {
+		if _, err := ds.Type(c, parent); err != nil {
+			if err.Error() == "KEY_NOT_FOUND" {
+				continue
+			}
+			return nil, err
+		}
+		parents = append(parents, parent)
+	}
+	return parents, nil
+}
+
+// walk reads the stored graph below ids breadth first.
+func (ds *documentStore) walk(c *gin.Context, ids []string) (*storedGraph, error) {
+	g, err := ds.reach(c, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	bodies, err := ds.bodies(c, g.order)
+	if err != nil {
+		return nil, err
+	}
+	g.bodies = bodies
+	return g, nil
+}
+
+// reach reads the edges of the stored graph below ids breadth first,
+// without the objects themselves.
+func (ds *documentStore) reach(c *gin.Context, ids []string) (*storedGraph, error) {
+	g := &storedGraph{children: make(map[string][]string)}
+	queue := append([]string(nil), ids...)
+	for _, id := range ids {
+		g.children[id] = nil
+	}
+
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		g.order = append(g.order, id)
+
+		children, err := ds.repo.SMembers(c, edgesKey(id))
+		if err != nil {
+			log.Printf("Error reading the children of %s from redis : %v", id, err)
+			return nil, err
+		}
+		g.children[id] = children
+		for _, child := range children {
+			if !g.contains(child) {
+				g.children[child] = nil
+				queue = append(queue, child)
+			}
+		}
+	}
+	return g, nil
+}
+
+// unreferenced returns the objects of g that nothing will reference once
+// the write is applied. Objects in current are being written and stay;
+// forced is removed in any case. An object stays when an object outside g
+// still references it, or an object of g that stays and keeps its edges.
+func (ds *documentStore) unreferenced(c *gin.Context, g *storedGraph, current map[string]bool, forced string) ([]string, error) {
+	candidate := func(id string) bool {
+		return !current[id] && id != forced
+	}
+
+	referenced := make(map[string]bool)
+	queue := make([]string, 0)
+	for _, id := range g.order {
+		if !candidate(id) {
+			continue
+		}
+		parents, err := ds.parents(c, id)
+		if err != nil {
+			return nil, err
+		}
+		for _, parent := range parents {
+			if !g.contains(parent) {
+				referenced[id] = true
+				queue = append(queue, id)
+				break
+			}
+		}
+	}
+
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, child := range g.children[id] {
+			if candidate(child) && !referenced[child] {
+				referenced[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	removed := make([]string, 0)
+	for _, id := range g.order {
+		if candidate(id) && !referenced[id] || id == forced {
+			removed = append(removed, id)
+		}
+	}
+	return removed, nil
+}
+
+// drop queues the removal of the stored object objectId of g and of the
+// edges it holds.
+func drop(tx repositories.RedisTx, g *storedGraph, objectId string) {
+	if body, ok := g.bodies[objectId]; ok {
+		_, objectType, _ := graph.Identity(body)
+		tx.Delete(objectKey(objectType, objectId))
+	}
+	tx.Delete(idKey(objectId), edgesKey(objectId), parentsKey(objectId))
+	for _, child := range g.children[objectId] {
+		tx.SRem(parentsKey(child), objectId)
+	}
+}
+
+// bodies reads the stored objects among ids, as kept under their own keys.
+// Ids that are not stored are left out.
+func (ds *documentStore) bodies(c *gin.Context, ids []string) (map[string]map[string]interface{}, error) {
+	bodies := make(map[string]map[string]interface{}, len(ids))
+	for _, id := range ids {
+		objectType, err := ds.Type(c, id)
+		if err != nil {
+			if err.Error() == "KEY_NOT_FOUND" {
+				continue
+			}
+			log.Printf("Error reading object %s from redis : %v", id, err)
+			return nil, err
+		}
+		value, err := ds.repo.Get(c, objectKey(objectType, id))
+		if err != nil {
+			if err.Error() == "KEY_NOT_FOUND" {
+				continue
+			}
+			log.Printf("Error reading object %s from redis : %v", id, err)
+			return nil, err
+		}
+
+		var body map[string]interface{}
+		if err := json.Unmarshal([]byte(value), &body); err != nil {
+			log.Printf("Error unmarshalling object %s from redis : %v", id, err)
+			continue
+		}
+		bodies[id] = body
+	}
+	return bodies, nil
+}
+
+func (ds *documentStore) Migrate(c *gin.Context) error {
+	version := 0
+	if value, err := ds.repo.Get(c, storageVersionKey); err == nil {
+		version, _ = strconv.Atoi(value)
+	}
+	if version >= storageVersion {
+		return nil
+	}
+
+	keys, err := ds.repo.Keys(c, "*")
+	if err != nil {
+		log.Printf("Error fetching all the keys from the redis : %v", err)
+		return err
+	}
+
+	if version < 2 {
+		// Earlier versions stored objects under their bare objectId; every
+		// other key is namespaced
+		legacy := make([]string, 0)
+		for _, key := range keys {
+			if !strings.Contains(key, ":") {
+				legacy = append(legacy, key)
+			}
+		}
+		for start := 0; start < len(legacy); start += migrateBatch {
+			end := min(start+migrateBatch, len(legacy))
+			if err := ds.migrate(c, legacy[start:end]); err != nil {
+				return err
+			}
+		}
+		log.Printf("Migrated %d stored objects", len(legacy))
+	}
+
+	if version < 3 {
+		// Earlier versions wrote every key with a 7 hour TTL. Only retention
+		// sentinels expire now.
+		persisted := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if !strings.HasPrefix(key, expiresPrefix) && strings.Contains(key, ":") {
+				persisted = append(persisted, key)
+			}
+		}
+		for start := 0; start < len(persisted); start += migrateBatch {
+			end := min(start+migrateBatch, len(persisted))
+			err := ds.repo.Batch(c, func(tx repositories.RedisTx) error {
+				for _, key := range persisted[start:end] {
+					tx.Persist(key)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		log.Printf("Removed the expiry of %d keys", len(persisted))
+	}
+
+	return ds.repo.Batch(c, func(tx repositories.RedisTx) error {
+		tx.Set(storageVersionKey, strconv.Itoa(storageVersion))
+		// Marker of the listing sets, which the migration covers
+		tx.Delete("index:listing:version")
+		return nil
+	})
+}
+
+// migrate moves the objects stored under the bare keys ids, in one
+// transaction. The edges sets already use objectIds and stay as they are.
+func (ds *documentStore) migrate(c *gin.Context, ids []string) error {
+	bodies := make(map[string]map[string]interface{}, len(ids))
+	for _, id := range ids {
+		value, err := ds.repo.Get(c, id)
+		if err != nil {
+			if err.Error() == "KEY_NOT_FOUND" {
+				continue
+			}
+			return err
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal([]byte(value), &body); err != nil {
+			log.Printf("Skipping key %s that does not hold an object : %v", id, err)
+			continue
+		}
+		if _, objectType, ok := graph.Identity(body); !ok || reservedNamespaces[objectType] {
+			log.Printf("Skipping key %s that does not hold an object", id)
+			continue
+		}
+		bodies[id] = body
+	}
+
+	return ds.repo.Batch(c, func(tx repositories.RedisTx) error {
+		for id, body := range bodies {
+			value, err := json.Marshal(body)
+			if err != nil {
+				return err
+			}
+			_, objectType, _ := graph.Identity(body)
+			tx.Set(objectKey(objectType, id), string(value))
+			tx.Set(idKey(id), objectType)
+			tx.Delete(id)
+			for key, member := range listingEntries(id, body) {
+				tx.ZAdd(key, member)
+			}
+			for _, child := range refs(body) {
+				tx.SAdd(parentsKey(child), id)
+			}
+		}
+		return nil
+	})
+}
+
+// refs returns the objectIds body references.
+func refs(value interface{}) []string {
+	if id, ok := graph.Ref(value); ok {
+		return []string{id}
+	}
+
+	ids := make([]string, 0)
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, child := range v {
+			ids = append(ids, refs(child)...)
+		}
+	case []interface{}:
+		for _, item := range v {
+			ids = append(ids, refs(item)...)
+		}
+	}
+	return ids
+}
+
+func objectKey(objectType, objectId string) string {
+	return objectType + ":" + objectId
+}
+
+func idKey(objectId string) string {
+	return "id:" + objectId
+}
+
+func edgesKey(objectId string) string {
+	return "edges:" + objectId
+}
+
+func parentsKey(objectId string) string {
+	return "parents:" + objectId
+}
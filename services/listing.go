@@ -0,0 +1,178 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"info7255-bigdata-app/graph"
+	"info7255-bigdata-app/models"
+	"info7255-bigdata-app/repositories"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Objects are listed from sorted sets whose members all have score 0, so
+// ZRANGEBYLEX pages through them in order without ever scanning the keyspace:
+//
+//	index:type:{objectType}                           objectIds
+//	index:type:{objectType}:creationDate              {yyyyMMdd}|{objectId}
+//	index:org:{org}:type:{objectType}                 objectIds
+//	index:org:{org}:type:{objectType}:creationDate    {yyyyMMdd}|{objectId}
+const (
+	// listingPage is how many members ListPlanIds reads at a time.
+	listingPage = 500
+	// creationDateLayout is the format plans carry their creationDate in.
+	creationDateLayout = "01-02-2006"
+)
+
+var errInvalidCursor = errors.New("INVALID_CURSOR")
+
+// listingKey returns the sorted set listing objectType objects, of org when
+// org is set, in the order of sort.
+func listingKey(objectType, org, sort string) string {
+	key := "index:type:" + objectType
+	if org != "" {
+		key = "index:org:" + org + ":type:" + objectType
+	}
+	if sort == "creationDate" {
+		key += ":creationDate"
+	}
+	return key
+}
+
+// listingEntries returns the sorted set members, by key, that list the object
+// stored as body.
+func listingEntries(objectId string, body map[string]interface{}) map[string]string {
+	_, objectType, ok := graph.Identity(body)
+	if !ok {
+		return nil
+	}
+	org, _ := body["_org"].(string)
+
+	entries := map[string]string{
+		listingKey(objectType, "", "objectId"): objectId,
+	}
+	if org != "" {
+		entries[listingKey(objectType, org, "objectId")] = objectId
+	}
+	if value, ok := body["creationDate"].(string); ok {
+		if date, err := time.Parse(creationDateLayout, value); err == nil {
+			member := date.Format("20060102") + "|" + objectId
+			entries[listingKey(objectType, "", "creationDate")] = member
+			if org != "" {
+				entries[listingKey(objectType, org, "creationDate")] = member
+			}
+		}
+	}
+	return entries
+}
+
+// listingObjectId returns the objectId a listing member stands for.
+func listingObjectId(member string) string {
+	if i := strings.IndexByte(member, '|'); i >= 0 {
+		return member[i+1:]
+	}
+	return member
+}
+
+// listingCursor is the position after the last member of a page. Key and
+// Order tie it to the query it was issued for.
+type listingCursor struct {
+	Key   string `json:"k"`
+	Order string `json:"o"`
+	After string `json:"a"`
+}
+
+func encodeCursor(cursor listingCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (listingCursor, error) {
+	var cursor listingCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, errInvalidCursor
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.After == "" {
+		return cursor, errInvalidCursor
+	}
+	return cursor, nil
+}
+
+func (ps *planService) ListPlans(c *gin.Context, query models.PlanListQuery) (models.PlanPage, error) {
+	page := models.PlanPage{Items: make([]map[string]interface{}, 0, query.Limit)}
+	key := listingKey(query.ObjectType, query.Org, query.Sort)
+	desc := query.Order == "desc"
+
+	min, max := "-", "+"
+	if query.Cursor != "" {
+		cursor, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return page, err
+		}
+		if cursor.Key != key || cursor.Order != query.Order {
+			return page, errInvalidCursor
+		}
+		if desc {
+			max = "(" + cursor.After
+		} else {
+			min = "(" + cursor.After
+		}
+	}
+
+	// One extra member tells whether another page follows
+	var members []string
+	var err error
+	if desc {
+		members, err = ps.repo.ZRevRangeByLex(c, key, max, min, int64(query.Limit)+1)
+	} else {
+		members, err = ps.repo.ZRangeByLex(c, key, min, max, int64(query.Limit)+1)
+	}
+	if err != nil {
+		log.Printf("Error listing %s from the redis : %v", key, err)
+		return page, err
+	}
+	if len(members) > query.Limit {
+		members = members[:query.Limit]
+		page.NextCursor = encodeCursor(listingCursor{Key: key, Order: query.Order, After: members[len(members)-1]})
+	}
+
+	for _, member := range members {
+		doc, err := ps.store.Load(c, listingObjectId(member))
+		if err != nil {
+			if err.Error() == "KEY_NOT_FOUND" {
+				// Expired since it was listed
+				continue
+			}
+			log.Printf("Error assembling object %s from the redis : %v", member, err)
+			return page, err
+		}
+		page.Items = append(page.Items, doc)
+	}
+	return page, nil
+}
+
+// index queues the listing entries of nodes, after removing the entries the
+// objects had when they were stored as previous.
+func index(tx repositories.RedisTx, previous map[string]map[string]interface{}, nodes []graph.Node) {
+	unindex(tx, previous)
+	for _, node := range nodes {
+		for key, member := range listingEntries(node.ObjectId, node.Body) {
+			tx.ZAdd(key, member)
+		}
+	}
+}
+
+// unindex queues the removal of the listing entries of the stored objects.
+func unindex(tx repositories.RedisTx, bodies map[string]map[string]interface{}) {
+	for objectId, body := range bodies {
+		for key, member := range listingEntries(objectId, body) {
+			tx.ZRem(key, member)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"info7255-bigdata-app/models"
+	"info7255-bigdata-app/rabbitmq"
+	"info7255-bigdata-app/repositories"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	outboxPendingKey   = "outbox:pending"
+	outboxDeliveredKey = "outbox:delivered"
+	outboxSequenceKey  = "outbox:seq"
+
+	// outboxDeliveredLimit caps how many delivered ids are kept for
+	// inspection. The entries themselves are deleted on delivery.
+	outboxDeliveredLimit = 1000
+
+	outboxPollInterval = time.Second
+	outboxMinBackoff   = time.Second
+	outboxMaxBackoff   = 5 * time.Minute
+)
+
+// Outbox records messages in the same Redis transaction as the data they
+// describe and relays them to RabbitMQ afterwards, so a failed publish can
+// never leave Redis and the index out of step.
+type Outbox interface {
+	// Enqueue queues message on tx. It is only published once tx commits.
+	Enqueue(ctx context.Context, tx repositories.RedisTx, queue string, message interface{}) error
+	// Notify wakes the relay after a commit instead of waiting for the next poll.
+	Notify()
+	// Run relays pending entries until ctx is cancelled.
+	Run(ctx context.Context)
+}
+
+type outbox struct {
+	repo      repositories.RedisRepo
+	publisher rabbitmq.Publisher
+	wake      chan struct{}
+}
+
+func NewOutbox(repo repositories.RedisRepo, publisher rabbitmq.Publisher) Outbox {
+	return &outbox{
+		repo:      repo,
+		publisher: publisher,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+func (o *outbox) Enqueue(ctx context.Context, tx repositories.RedisTx, queue string, message interface{}) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Errorf("Error marshalling the outbox message : %v", err)
+		return err
+	}
+
+	// Ids are allocated outside the transaction; an aborted batch only
+	// leaves a gap in the sequence.
+	id, err := o.repo.Incr(ctx, outboxSequenceKey)
+	if err != nil {
+		log.Printf("Error allocating an outbox id in redis : %v", err)
+		return err
+	}
+
+	entry := models.OutboxEntry{
+		ID:        id,
+		Queue:     queue,
+		Payload:   payload,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	value, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("Error marshalling the outbox entry : %v", err)
+		return err
+	}
+
+	tx.Set(outboxEntryKey(id), string(value))
+	tx.RPush(outboxPendingKey, strconv.FormatInt(id, 10))
+	return nil
+}
+
+func (o *outbox) Notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *outbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		o.drain(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// drain publishes pending entries oldest first. It stops at the first entry
+// that cannot be published yet so the indexer sees changes in commit order.
+func (o *outbox) drain(ctx context.Context) {
+	ids, err := o.repo.LRange(ctx, outboxPendingKey, 0, -1)
+	if err != nil {
+		log.Printf("Error reading the outbox from redis : %v", err)
+		return
+	}
+
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+
+		value, err := o.repo.Get(ctx, outboxKey(id))
+		if err != nil {
+			if err.Error() == "KEY_NOT_FOUND" {
+				log.Errorf("Dropping outbox entry %s : the entry no longer exists", id)
+				err = o.repo.Batch(ctx, func(tx repositories.RedisTx) error {
+					tx.LRem(outboxPendingKey, id)
+					return nil
+				})
+				if err != nil {
+					log.Printf("Error removing outbox entry %s from redis : %v", id, err)
+					return
+				}
+				continue
+			}
+			log.Printf("Error reading outbox entry %s from redis : %v", id, err)
+			return
+		}
+
+		var entry models.OutboxEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			log.Errorf("Error unmarshalling outbox entry %s : %v", id, err)
+			return
+		}
+
+		now := time.Now().UTC()
+		if entry.NextAttemptAt != "" {
+			next, err := time.Parse(time.RFC3339Nano, entry.NextAttemptAt)
+			if err == nil && now.Before(next) {
+				return
+			}
+		}
+
+		entry.Attempts++
+		if err := o.publisher.PublishMessage(entry.Queue, entry.Payload); err != nil {
+			entry.LastError = err.Error()
+			entry.NextAttemptAt = now.Add(outboxBackoff(entry.Attempts)).Format(time.RFC3339Nano)
+			log.Errorf("Error relaying outbox entry %s (attempt %d) : %v", id, entry.Attempts, err)
+			if err := o.save(ctx, id, entry); err != nil {
+				log.Printf("Error updating outbox entry %s in redis : %v", id, err)
+			}
+			return
+		}
+
+		// A delivered entry is done with; only its id is kept
+		err = o.repo.Batch(ctx, func(tx repositories.RedisTx) error {
+			tx.Delete(outboxKey(id))
+			tx.LRem(outboxPendingKey, id)
+			tx.RPush(outboxDeliveredKey, id)
+			tx.LTrim(outboxDeliveredKey, -outboxDeliveredLimit, -1)
+			return nil
+		})
+		if err != nil {
+			// The message went out but is still pending, so it will be
+			// published again. The indexer treats repeats as overwrites.
+			log.Printf("Error marking outbox entry %s as delivered : %v", id, err)
+			return
+		}
+	}
+}
+
+func (o *outbox) save(ctx context.Context, id string, entry models.OutboxEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return o.repo.Batch(ctx, func(tx repositories.RedisTx) error {
+		tx.Set(outboxKey(id), string(value))
+		return nil
+	})
+}
+
+// outboxBackoff doubles the wait after every failed attempt up to
+// outboxMaxBackoff.
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxMinBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	return backoff
+}
+
+func outboxEntryKey(id int64) string {
+	return outboxKey(strconv.FormatInt(id, 10))
+}
+
+func outboxKey(id string) string {
+	return "outbox:entry:" + id
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"info7255-bigdata-app/database"
+	"info7255-bigdata-app/models"
+	"info7255-bigdata-app/repositories"
+	"reflect"
+	"testing"
+)
+
+// recordingPublisher records what it publishes, or fails with err.
+type recordingPublisher struct {
+	published []string
+	err       error
+}
+
+func (p *recordingPublisher) PublishMessage(queueName string, message interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.published = append(p.published, queueName)
+	return nil
+}
+
+func TestDrainDeletesDeliveredEntries(t *testing.T) {
+	ctx := context.Background()
+	repo := database.NewMemoryRepository()
+	publisher := &recordingPublisher{err: errors.New("connection refused")}
+	o := NewOutbox(repo, publisher).(*outbox)
+
+	err := repo.Batch(ctx, func(tx repositories.RedisTx) error {
+		return o.Enqueue(ctx, tx, "plans_queue", map[string]string{"operation": "create"})
+	})
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	ids, _ := repo.LRange(ctx, outboxPendingKey, 0, -1)
+	if len(ids) != 1 {
+		t.Fatalf("pending = %v, want one entry", ids)
+	}
+	id := ids[0]
+
+	// A failed publish keeps the entry for the next attempt
+	o.drain(ctx)
+
+	// Skip the backoff of the failed attempt
+	value, _ := repo.Get(ctx, outboxKey(id))
+	var entry models.OutboxEntry
+	if err := json.Unmarshal([]byte(value), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Attempts != 1 || entry.NextAttemptAt == "" {
+		t.Errorf("entry after the failed publish = %+v, want one attempt and a backoff", entry)
+	}
+	entry.NextAttemptAt = ""
+	if err := o.save(ctx, id, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher.err = nil
+	o.drain(ctx)
+
+	if !reflect.DeepEqual(publisher.published, []string{"plans_queue"}) {
+		t.Errorf("published = %v, want one message to plans_queue", publisher.published)
+	}
+	if _, err := repo.Get(ctx, outboxKey(id)); err == nil || err.Error() != "KEY_NOT_FOUND" {
+		t.Errorf("Get(%s) after delivery = %v, want KEY_NOT_FOUND", outboxKey(id), err)
+	}
+	if pending, _ := repo.LRange(ctx, outboxPendingKey, 0, -1); len(pending) != 0 {
+		t.Errorf("pending after delivery = %v, want none", pending)
+	}
+	if delivered, _ := repo.LRange(ctx, outboxDeliveredKey, 0, -1); !reflect.DeepEqual(delivered, []string{id}) {
+		t.Errorf("delivered = %v, want [%s]", delivered, id)
+	}
+}
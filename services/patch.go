@@ -0,0 +1,143 @@
+package services
+
+import (
+	"errors"
+	"info7255-bigdata-app/graph"
+	"info7255-bigdata-app/patch"
+)
+
+// Patch is a partial update of a stored plan in one of the formats PATCH
+// accepts. Apply returns the patched copy of the stored document.
+type Patch interface {
+	Apply(existing map[string]interface{}) (map[string]interface{}, error)
+}
+
+// PartialPlan is a plan PATCH sent as application/json: planCostShares is
+// merged field by field, linkedPlanServices are replaced or appended by
+// objectId, and every other property sent overwrites the stored value.
+type PartialPlan map[string]interface{}
+
+// MergePatch is a JSON Merge Patch (RFC 7396). Members set to null are
+// removed, arrays are replaced whole.
+type MergePatch map[string]interface{}
+
+// JSONPatch is a JSON Patch (RFC 6902), e.g. a remove of
+// /linkedPlanServices/0 or a test of /_org before a replace.
+type JSONPatch []patch.Operation
+
+func (p PartialPlan) Apply(existing map[string]interface{}) (map[string]interface{}, error) {
+	// Only the identities are compared; the schema decides what else a
+	// plan may hold
+	if objectId, _ := p["objectId"].(string); objectId != "" && objectId != existing["objectId"] {
+		return nil, errors.New("ObjectId mismatch in plan")
+	}
+	current, _ := existing["planCostShares"].(map[string]interface{})
+	update, _ := p["planCostShares"].(map[string]interface{})
+	if current != nil && update != nil && current["objectId"] != update["objectId"] {
+		return nil, errors.New("ObjectId mismatch in planCostShares")
+	}
+
+	return mergePlan(existing, p), nil
+}
+
+func (p MergePatch) Apply(existing map[string]interface{}) (map[string]interface{}, error) {
+	merged, _ := patch.Merge(existing, map[string]interface{}(p)).(map[string]interface{})
+	return merged, nil
+}
+
+func (p JSONPatch) Apply(existing map[string]interface{}) (map[string]interface{}, error) {
+	result, err := patch.Apply(existing, p)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := result.(map[string]interface{})
+	if !ok {
+		return nil, &patch.Error{Kind: patch.Unprocessable, Index: -1, Message: "the patched plan must be a JSON object"}
+	}
+	return doc, nil
+}
+
+// mergePlan applies a partial plan on top of the stored one. planCostShares is
+// merged field by field, linkedPlanServices are replaced or appended by
+// objectId, and every other property sent overwrites the stored value.
+func mergePlan(existing, patch map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(existing))
+	for key, value := range existing {
+		merged[key] = value
+	}
+
+	for key, value := range patch {
+		switch key {
+		case "objectId":
+			continue
+		case "planCostShares":
+			current, ok := merged[key].(map[string]interface{})
+			update, isObject := value.(map[string]interface{})
+			if !ok || !isObject {
+				merged[key] = value
+				continue
+			}
+			costShares := make(map[string]interface{}, len(current))
+			for k, v := range current {
+				costShares[k] = v
+			}
+			for k, v := range update {
+				costShares[k] = v
+			}
+			merged[key] = costShares
+		case "linkedPlanServices":
+			current, _ := merged[key].([]interface{})
+			updates, ok := value.([]interface{})
+			if !ok {
+				merged[key] = value
+				continue
+			}
+			merged[key] = mergeByObjectId(current, updates)
+		default:
+			merged[key] = value
+		}
+	}
+
+	return merged
+}
+
+// mergeByObjectId replaces items of current that share an objectId with an
+// update and appends the remaining updates in the order they were sent.
+func mergeByObjectId(current, updates []interface{}) []interface{} {
+	pending := make(map[string]interface{}, len(updates))
+	for _, update := range updates {
+		if obj, ok := update.(map[string]interface{}); ok {
+			if id, _, ok := graph.Identity(obj); ok {
+				pending[id] = update
+			}
+		}
+	}
+
+	result := make([]interface{}, 0, len(current)+len(updates))
+	for _, item := range current {
+		if obj, ok := item.(map[string]interface{}); ok {
+			if id, _, ok := graph.Identity(obj); ok {
+				if update, found := pending[id]; found {
+					result = append(result, update)
+					delete(pending, id)
+					continue
+				}
+			}
+		}
+		result = append(result, item)
+	}
+
+	for _, update := range updates {
+		obj, ok := update.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if id, _, ok := graph.Identity(obj); ok {
+			if _, found := pending[id]; found {
+				result = append(result, update)
+			}
+		}
+	}
+
+	return result
+}
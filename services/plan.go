@@ -3,419 +3,539 @@ package services
 import (
 	"encoding/json"
 	"errors"
+	"info7255-bigdata-app/graph"
 	"info7255-bigdata-app/models"
 	"info7255-bigdata-app/rabbitmq"
 	"info7255-bigdata-app/repositories"
+	"reflect"
+	"sort"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/gin-gonic/gin"
 )
 
+// PlanService stores plans exactly as they were sent. Documents are generic
+// JSON objects, checked against the schema of their objectType.
 type PlanService interface {
-	GetAnyObject(c *gin.Context, key string) (interface{}, error)
-	GetPlan(c *gin.Context, key string) (models.Plan, error)
-	CreatePlan(c *gin.Context, plan models.Plan) error
-	DeletePlan(c *gin.Context, key string) error
-	PatchPlan(c *gin.Context, key string, plan models.Plan) (models.Plan, error)
-	UpdatePlan(c *gin.Context, key string, plan models.Plan) error
-	GetAllPlans(ctx *gin.Context) ([]models.Plan, error)
+	GetAnyObject(c *gin.Context, key string) (map[string]interface{}, error)
+	CreatePlan(c *gin.Context, plan map[string]interface{}, opts models.WriteOptions) error
+	DeletePlan(c *gin.Context, key string, opts models.WriteOptions) error
+	// PatchPlan applies patch to the stored plan and stores the result. It
+	// fails with "ObjectId mismatch" when the patch changes the objectId.
+	PatchPlan(c *gin.Context, key string, patch Patch, opts models.WriteOptions) (map[string]interface{}, error)
+	UpdatePlan(c *gin.Context, key string, plan map[string]interface{}, opts models.WriteOptions) error
+	// ListPlans returns one page of stored objects. It fails with
+	// INVALID_CURSOR when query.Cursor was not issued for the same query.
+	ListPlans(c *gin.Context, query models.PlanListQuery) (models.PlanPage, error)
+	// ListPlanIds returns the objectId of every stored plan, sorted.
+	ListPlanIds(ctx *gin.Context) ([]string, error)
+	// LastModified returns when any object of doc was last written, or the
+	// zero time when none of them records it.
+	LastModified(c *gin.Context, doc map[string]interface{}) (time.Time, error)
+	// GraphVersions returns the versions of objectId and of every stored
+	// object below it, 0 for those never written. Writes with
+	// WriteOptions.IfVersions fail with VERSION_CONFLICT unless the graph
+	// still holds exactly these versions.
+	GraphVersions(c *gin.Context, objectId string) (map[string]int64, error)
+	// GetVersioned is GetAnyObject together with the GraphVersions the
+	// document was read at. When objectId is not stored it fails with
+	// KEY_NOT_FOUND and still returns the versions, to pin a create to.
+	GetVersioned(c *gin.Context, objectId string) (map[string]interface{}, map[string]int64, error)
+	// Versions returns the versions of the objects of doc that have one, for
+	// messages that index stored plans.
+	Versions(c *gin.Context, doc map[string]interface{}) (map[string]int64, error)
+	// ReferencingPlans returns the ids of the plans whose graph contains
+	// objectId.
+	ReferencingPlans(c *gin.Context, objectId string) ([]string, error)
 }
 
 type planService struct {
-	repo repositories.RedisRepo
+	repo      repositories.RedisRepo
+	store     DocumentStore
+	schemas   SchemaService
+	outbox    Outbox
+	retention RetentionPolicy
 }
 
-func NewPlanService(repo repositories.RedisRepo) PlanService {
+func NewPlanService(repo repositories.RedisRepo, store DocumentStore, schemas SchemaService, outbox Outbox, retention RetentionPolicy) PlanService {
 	return &planService{
-		repo: repo,
+		repo:      repo,
+		store:     store,
+		schemas:   schemas,
+		outbox:    outbox,
+		retention: retention,
 	}
 }
 
-func (ps *planService) GetPlan(ctx *gin.Context, key string) (models.Plan, error) {
-	var plan models.Plan
-
-	value, err := ps.repo.Get(ctx, key)
+func (ps *planService) CreatePlan(c *gin.Context, plan map[string]interface{}, opts models.WriteOptions) error {
+	metas, err := ps.schemas.ValidateDocument(c, plan)
 	if err != nil {
-		log.Printf("Error getting the plan from redis : %v", err)
-		return plan, err
-	}
-
-	if err := json.Unmarshal([]byte(value), &plan); err != nil {
-		log.Printf("Error unmarshalling the plan from redis : %v", err)
-		return plan, err
-	}
-
-	return plan, nil
-}
-
-func (ps *planService) CreatePlan(c *gin.Context, plan models.Plan) error {
-	objectId := plan.ObjectId
-
-	// Marshal the struct into a string
-	value, err := json.Marshal(plan)
-	if err != nil {
-		log.Errorf("Error marshalling the plan struct : %v", err)
+		log.Printf("Plan %v failed schema validation : %v", plan["objectId"], err)
 		return err
 	}
-	err = ps.repo.Set(c, objectId, string(value))
+	objectId, _ := plan["objectId"].(string)
+
+	// Store the plan graph, its metadata and the creation message as one
+	// transaction
+	err = ps.optimistic(c, objectId, opts.IfVersions, func(watch func(keys ...string) error, tx repositories.RedisTx, stored map[string]int64) error {
+		if err := ps.watchDocument(c, watch, plan); err != nil {
+			return err
+		}
+		nodes, removed, err := ps.store.Save(c, tx, plan)
+		if err != nil {
+			return err
+		}
+		versions, err := ps.bumpVersions(c, watch, tx, append(touched(nodes, stored), removed...))
+		if err != nil {
+			return err
+		}
+		if err := saveMetas(tx, metas); err != nil {
+			return err
+		}
+		ps.retain(tx, nodes[0].ObjectId, nodes[0].ObjectType, opts, false)
+		err = ps.outbox.Enqueue(c, tx, rabbitmq.PlansQueue, models.PlanMessage{
+			Operation:   "create",
+			Plan:        plan,
+			Versions:    versions,
+			CommittedAt: commitTime(),
+		})
+		if err != nil {
+			return err
+		}
+		return ps.queueReferencing(c, watch, tx, objectId, written(nodes), versions)
+	})
 	if err != nil {
 		log.Printf("Error setting the plan in the redis : %v", err)
 		return err
 	}
+	ps.outbox.Notify()
 
-	pValue, err := json.Marshal(plan.PlanCostShares)
-	if err != nil {
-		log.Errorf("Error marshalling the plan struct : %v", err)
-		return err
-	}
-	err = ps.repo.Set(c, plan.PlanCostShares.ObjectId, string(pValue))
+	return nil
+}
+
+func (ps *planService) DeletePlan(c *gin.Context, objectId string, opts models.WriteOptions) error {
+	// Delete the plan together with every object below it that no other
+	// plan references, and queue the deletion message, in one transaction
+	err := ps.optimistic(c, objectId, opts.IfVersions, func(watch func(keys ...string) error, tx repositories.RedisTx, stored map[string]int64) error {
+		ids, err := ps.store.Delete(c, tx, objectId)
+		if err != nil {
+			return err
+		}
+		// Objects still referencing objectId lose an edge
+		parents, err := ps.repo.SMembers(c, parentsKey(objectId))
+		if err != nil {
+			return err
+		}
+		versions, err := ps.bumpVersions(c, watch, tx, append(touched(nil, stored), parents...))
+		if err != nil {
+			return err
+		}
+		deleteMetas(tx, ids)
+		tx.Delete(retentionKey(objectId), expiresKey(objectId))
+		err = ps.outbox.Enqueue(c, tx, rabbitmq.PlansQueue, models.PlanMessage{
+			Operation:   "delete",
+			Removed:     removedRefs(objectId, departed(nil, stored)),
+			Versions:    versions,
+			CommittedAt: commitTime(),
+		})
+		if err != nil {
+			return err
+		}
+		// Plans that share the object lose it
+		return ps.queueReferencing(c, watch, tx, objectId, map[string]map[string]interface{}{objectId: nil}, versions)
+	})
 	if err != nil {
-		log.Printf("Error setting the plan in the redis : %v", err)
+		log.Printf("Error deleting the plan from the redis : %v", err)
 		return err
 	}
+	ps.outbox.Notify()
 
-	// Iterate over the linkedPlanServices array and set each object in Redis
-	for _, linkedPlanService := range plan.LinkedPlanServices {
-		// Marshal and store the entire linkedPlanService object in Redis
-		linkedPlanServiceValue, err := json.Marshal(linkedPlanService)
+	return nil
+}
+
+func (ps *planService) PatchPlan(ctx *gin.Context, key string, patch Patch, opts models.WriteOptions) (map[string]interface{}, error) {
+	var merged map[string]interface{}
+
+	// The patch is applied to the plan as read inside the transaction, so a
+	// concurrent write is either seen or makes the commit fail
+	err := ps.optimistic(ctx, key, opts.IfVersions, func(watch func(keys ...string) error, tx repositories.RedisTx, stored map[string]int64) error {
+		existing, err := ps.store.Load(ctx, key)
 		if err != nil {
-			log.Errorf("Error marshalling the linkedPlanService struct : %v", err)
 			return err
 		}
 
-		err = ps.repo.Set(c, linkedPlanService.ObjectId, string(linkedPlanServiceValue))
+		merged, err = patch.Apply(existing)
 		if err != nil {
+			log.Printf("Error applying the patch to plan %s : %v", key, err)
 			return err
 		}
+		if objectId, _, _ := graph.Identity(merged); objectId != key {
+			validationErr := errors.New("ObjectId mismatch in plan")
+			log.Errorf("Error updating plan : %v", validationErr)
+			return validationErr
+		}
 
-		// Marshal and store the linkedService object in Redis
-		linkedServiceValue, err := json.Marshal(linkedPlanService.LinkedService)
+		// Validate the merged plan before anything is written
+		metas, err := ps.schemas.ValidateDocument(ctx, merged)
 		if err != nil {
-			log.Errorf("Error marshalling the linkedService struct : %v", err)
+			log.Printf("Patched plan %s failed schema validation : %v", key, err)
 			return err
 		}
 
-		err = ps.repo.Set(c, linkedPlanService.LinkedService.ObjectId, string(linkedServiceValue))
+		if err := ps.watchDocument(ctx, watch, merged); err != nil {
+			return err
+		}
+		nodes, removed, err := ps.store.Save(ctx, tx, merged)
 		if err != nil {
 			return err
 		}
-
-		// Marshal and store the planserviceCostShares object in Redis
-		planserviceCostSharesValue, err := json.Marshal(linkedPlanService.PlanServiceCostShares)
+		versions, err := ps.bumpVersions(ctx, watch, tx, append(touched(nodes, stored), removed...))
 		if err != nil {
-			log.Errorf("Error marshalling the planserviceCostShares struct : %v", err)
 			return err
 		}
-
-		err = ps.repo.Set(c, linkedPlanService.PlanServiceCostShares.ObjectId, string(planserviceCostSharesValue))
+		deleteMetas(tx, removed)
+		if err := saveMetas(tx, metas); err != nil {
+			return err
+		}
+		ps.retain(tx, key, nodes[0].ObjectType, opts, true)
+		err = ps.outbox.Enqueue(ctx, tx, rabbitmq.PlansQueue, models.PlanMessage{
+			Operation:   "patch",
+			Plan:        merged,
+			Removed:     removedRefs(key, departed(nodes, stored)),
+			Versions:    versions,
+			CommittedAt: commitTime(),
+		})
 		if err != nil {
 			return err
 		}
-	}
-
-	// Publish the plan creation message to RabbitMQ
-	message := models.PlanMessage{
-		Operation: "create",
-		Plan:      plan,
-	}
-
-	rmq := &rabbitmq.Factory{}
-	err = rmq.PublishMessage("plans_queue", message)
+		return ps.queueReferencing(ctx, watch, tx, key, written(nodes), versions)
+	})
 	if err != nil {
-		log.Errorf("Error publishing create message to RabbitMQ: %v", err)
-		return err
+		log.Printf("Error saving plan to redis: %v", err)
+		return nil, err
 	}
+	ps.outbox.Notify()
 
-	return nil
+	return merged, nil
 }
 
-func (ps *planService) DeletePlan(c *gin.Context, objectId string) error {
-	// Fetch the plan
-	plan, err := ps.GetPlan(c, objectId)
+func (ps *planService) UpdatePlan(ctx *gin.Context, key string, plan map[string]interface{}, opts models.WriteOptions) error {
+	// Reject an invalid replacement before the existing plan is touched
+	metas, err := ps.schemas.ValidateDocument(ctx, plan)
 	if err != nil {
-		log.Printf("Error getting the plan from the redis : %v", err)
+		log.Printf("Replacement plan %s failed schema validation : %v", key, err)
 		return err
 	}
 
-	// Delete the plan
-	err = ps.repo.Delete(c, objectId)
-	if err != nil {
-		log.Printf("Error deleting the plan from the redis : %v", err)
-		return err
-	}
-
-	// Delete the PlanCostShares
-	err = ps.repo.Delete(c, plan.PlanCostShares.ObjectId)
-	if err != nil {
-		log.Printf("Error deleting the PlanCostShares from the redis : %v", err)
-		return err
-	}
+	// Replace the whole graph in one transaction. Save drops every object
+	// the replacement no longer contains.
+	err = ps.optimistic(ctx, key, opts.IfVersions, func(watch func(keys ...string) error, tx repositories.RedisTx, stored map[string]int64) error {
+		if _, err := ps.store.Type(ctx, key); err != nil {
+			log.Printf("Error getting the plan from the redis : %v", err)
+			return err
+		}
 
-	// Delete each LinkedPlanService and its related objects
-	for _, linkedPlanService := range plan.LinkedPlanServices {
-		// Delete the LinkedPlanService
-		err = ps.repo.Delete(c, linkedPlanService.ObjectId)
+		if err := ps.watchDocument(ctx, watch, plan); err != nil {
+			return err
+		}
+		nodes, removed, err := ps.store.Save(ctx, tx, plan)
 		if err != nil {
-			log.Printf("Error deleting the LinkedPlanService from the redis : %v", err)
-			return err // This line was uncommented
+			return err
 		}
-
-		// Delete the LinkedService
-		err = ps.repo.Delete(c, linkedPlanService.LinkedService.ObjectId)
+		versions, err := ps.bumpVersions(ctx, watch, tx, append(touched(nodes, stored), removed...))
 		if err != nil {
-			log.Printf("Error deleting the LinkedService from the redis : %v", err)
 			return err
 		}
-
-		// Delete the PlanServiceCostShares
-		err = ps.repo.Delete(c, linkedPlanService.PlanServiceCostShares.ObjectId)
+		deleteMetas(tx, removed)
+		if err := saveMetas(tx, metas); err != nil {
+			return err
+		}
+		ps.retain(tx, key, nodes[0].ObjectType, opts, false)
+		// Documents that stay are overwritten in place, so searches never
+		// miss the plan while the change is indexed
+		err = ps.outbox.Enqueue(ctx, tx, rabbitmq.PlansQueue, models.PlanMessage{
+			Operation:   "create",
+			Plan:        plan,
+			Removed:     removedRefs(key, departed(nodes, stored)),
+			Versions:    versions,
+			CommittedAt: commitTime(),
+		})
 		if err != nil {
-			log.Printf("Error deleting the PlanServiceCostShares from the redis : %v", err)
 			return err
 		}
+		return ps.queueReferencing(ctx, watch, tx, key, written(nodes), versions)
+	})
+	if err != nil {
+		log.Printf("Failed to replace plan with error : %v", err.Error())
+		return err
+	}
+	ps.outbox.Notify()
+
+	return nil
+}
+
+func (ps *planService) ListPlanIds(ctx *gin.Context) ([]string, error) {
+	key := listingKey("plan", "", "objectId")
+	ids := make([]string, 0)
+	min := "-"
+	for {
+		members, err := ps.repo.ZRangeByLex(ctx, key, min, "+", listingPage)
+		if err != nil {
+			log.Printf("Error listing the plans from the redis : %v", err)
+			return nil, err
+		}
+		ids = append(ids, members...)
+		if len(members) < listingPage {
+			return ids, nil
+		}
+		min = "(" + members[len(members)-1]
 	}
+}
 
-	// Publish the plan deletion message to RabbitMQ
-	message := models.PlanMessage{
-		Operation: "delete",
-		Plan:      plan,
+func (ps *planService) ReferencingPlans(c *gin.Context, objectId string) ([]string, error) {
+	roots, err := ps.store.Roots(c, objectId)
+	if err != nil {
+		log.Printf("Error finding the plans referencing %s : %v", objectId, err)
+		return nil, err
 	}
+	return roots, nil
+}
 
-	rmq := &rabbitmq.Factory{}
-	err = rmq.PublishMessage("plans_queue", message)
+func (ps *planService) GetAnyObject(ctx *gin.Context, key string) (map[string]interface{}, error) {
+	doc, err := ps.store.Load(ctx, key)
 	if err != nil {
-		log.Errorf("Error publishing delete message to RabbitMQ: %v", err)
-		return err
+		log.Printf("Error getting the object from the redis : %v", err)
+		return nil, err
 	}
 
-	return nil
+	return doc, nil
 }
 
-func (ps *planService) PatchPlan(ctx *gin.Context, key string, plan models.Plan) (models.Plan, error) {
-	existingPlan, err := ps.GetPlan(ctx, key)
-	if err != nil || existingPlan.ObjectId == "" {
-		return models.Plan{}, err
+func (ps *planService) LastModified(c *gin.Context, doc map[string]interface{}) (time.Time, error) {
+	nodes, err := graph.Split(doc)
+	if err != nil {
+		return time.Time{}, err
 	}
 
-	if plan.PlanCostShares != nil {
-		var pValue []byte
-		if existingPlan.PlanCostShares != nil {
-			if existingPlan.PlanCostShares.ObjectId != plan.PlanCostShares.ObjectId {
-				validationErr := errors.New("ObjectId mismatch in planCostShares")
-				log.Errorf("Error updating planCostShares : %v", validationErr)
-				return models.Plan{}, validationErr
-			}
-			existingPlan.PlanCostShares.UpdatePlanCostShares(*plan.PlanCostShares)
-			pValue, err = json.Marshal(existingPlan.PlanCostShares)
-			if err != nil {
-				log.Errorf("Error marshalling the plan struct : %v", err)
-				return models.Plan{}, err
-			}
-			err = ps.repo.Set(ctx, plan.PlanCostShares.ObjectId, string(pValue))
-			if err != nil {
-				log.Printf("Error setting the plan in the redis : %v", err)
-				return models.Plan{}, err
-			}
-		} else {
-			pValue, err = json.Marshal(plan.PlanCostShares)
-			if err != nil {
-				log.Errorf("Error marshalling the plan struct : %v", err)
-				return models.Plan{}, err
+	// A shared child can change without its plans being written, so the
+	// document is as recent as its most recently written object
+	var latest time.Time
+	for _, node := range nodes {
+		value, err := ps.repo.Get(c, metaKey(node.ObjectId))
+		if err != nil {
+			if err.Error() == "KEY_NOT_FOUND" {
+				continue
 			}
+			log.Printf("Error getting the object meta from the redis : %v", err)
+			return time.Time{}, err
+		}
+		var meta models.ObjectMeta
+		if err := json.Unmarshal([]byte(value), &meta); err != nil || meta.ModifiedAt == "" {
+			continue
+		}
+		modifiedAt, err := time.Parse(time.RFC3339, meta.ModifiedAt)
+		if err == nil && modifiedAt.After(latest) {
+			latest = modifiedAt
 		}
+	}
+	return latest, nil
+}
 
-		err = ps.repo.Set(ctx, plan.PlanCostShares.ObjectId, string(pValue))
+func saveMetas(tx repositories.RedisTx, metas map[string]models.ObjectMeta) error {
+	modifiedAt := time.Now().UTC().Format(time.RFC3339)
+	for objectId, meta := range metas {
+		meta.ModifiedAt = modifiedAt
+		value, err := json.Marshal(meta)
 		if err != nil {
-			log.Printf("Error setting the plan in the redis : %v", err)
-			return models.Plan{}, err
+			log.Errorf("Error marshalling the object meta : %v", err)
+			return err
 		}
+		tx.Set(metaKey(objectId), string(value))
 	}
+	return nil
+}
 
-	// Create a map of new LinkedPlanServices for easy lookup
-	newLinkedPlanServices := make(map[string]models.LinkedPlanService)
-	for _, newLinkedPlanService := range plan.LinkedPlanServices {
-		newLinkedPlanServices[newLinkedPlanService.ObjectId] = newLinkedPlanService
+// commitTime stamps a message with the time of its write.
+func commitTime() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+func deleteMetas(tx repositories.RedisTx, ids []string) {
+	for _, id := range ids {
+		tx.Delete(metaKey(id))
 	}
+}
 
-	// Update existing LinkedPlanServices if they are in the newLinkedPlanServices map
-	for i, existingLinkedPlanService := range existingPlan.LinkedPlanServices {
-		if newLinkedPlanService, ok := newLinkedPlanServices[existingLinkedPlanService.ObjectId]; ok {
-			existingPlan.LinkedPlanServices[i] = newLinkedPlanService
-			delete(newLinkedPlanServices, existingLinkedPlanService.ObjectId)
+// queueReferencing queues a create for every other plan holding one of the
+// objects a write of objectId changed, so their documents of a shared object
+// follow the change. changed maps each written object to its new content,
+// nil when it was deleted. The plans are watched like the written one, and
+// the objects whose nested content changes in them get new versions, which
+// are added to versions.
+func (ps *planService) queueReferencing(c *gin.Context, watch func(keys ...string) error, tx repositories.RedisTx, objectId string, changed map[string]map[string]interface{}, versions map[string]int64) error {
+	roots := make(map[string]bool)
+	for id := range changed {
+		found, err := ps.store.Roots(c, id)
+		if err != nil {
+			// Objects the write creates are in no other plan yet
+			if err.Error() == "KEY_NOT_FOUND" {
+				continue
+			}
+			return err
+		}
+		for _, root := range found {
+			if root != objectId {
+				roots[root] = true
+			}
 		}
 	}
 
-	// Append any remaining new LinkedPlanServices that were not in the existing plan
-	for _, newLinkedPlanService := range newLinkedPlanServices {
-		existingPlan.LinkedPlanServices = append(existingPlan.LinkedPlanServices, newLinkedPlanService)
+	rootIds := make([]string, 0, len(roots))
+	for id := range roots {
+		rootIds = append(rootIds, id)
+	}
+	sort.Strings(rootIds)
 
-		linkedPlanServiceValue, err := json.Marshal(newLinkedPlanService)
+	for _, rootId := range rootIds {
+		stored, err := ps.watchGraph(c, watch, []string{rootId})
 		if err != nil {
-			log.Errorf("Error marshalling the linkedPlanService struct : %v", err)
-			return models.Plan{}, err
+			return err
 		}
-
-		err = ps.repo.Set(ctx, newLinkedPlanService.ObjectId, string(linkedPlanServiceValue))
+		doc, err := ps.store.Load(c, rootId)
 		if err != nil {
-			return models.Plan{}, err
+			return err
 		}
-
-		// Marshal and store the linkedService object in Redis
-		linkedServiceValue, err := json.Marshal(newLinkedPlanService.LinkedService)
-		if err != nil {
-			log.Errorf("Error marshalling the linkedService struct : %v", err)
-			return models.Plan{}, err
+		replaced, updated, _ := replaceObjects(doc, changed)
+		if len(updated) == 0 {
+			continue
 		}
-
-		err = ps.repo.Set(ctx, newLinkedPlanService.LinkedService.ObjectId, string(linkedServiceValue))
+		plan := replaced.(map[string]interface{})
+		nodes, err := graph.Split(plan)
 		if err != nil {
-			return models.Plan{}, err
+			return err
 		}
 
-		// Marshal and store the planserviceCostShares object in Redis
-		planserviceCostSharesValue, err := json.Marshal(newLinkedPlanService.PlanServiceCostShares)
+		left := departed(nodes, stored)
+		bump := make([]string, 0)
+		for _, id := range append(updated, left...) {
+			if _, ok := versions[id]; !ok {
+				bump = append(bump, id)
+			}
+		}
+		bumped, err := ps.bumpVersions(c, watch, tx, bump)
 		if err != nil {
-			log.Errorf("Error marshalling the planserviceCostShares struct : %v", err)
-			return models.Plan{}, err
+			return err
+		}
+		for id, version := range bumped {
+			versions[id] = version
 		}
 
-		err = ps.repo.Set(ctx, newLinkedPlanService.PlanServiceCostShares.ObjectId, string(planserviceCostSharesValue))
+		// Objects the change leaves alone keep their versions, so the
+		// indexer skips their documents if they are current
+		planVersions := make(map[string]int64, len(nodes)+len(left))
+		for _, id := range append(nodeIds(nodes), left...) {
+			planVersions[id] = stored[id]
+			if version, ok := versions[id]; ok {
+				planVersions[id] = version
+			}
+		}
+		log.Printf("Reindexing plan %s, which shares objects with %s", rootId, objectId)
+		err = ps.outbox.Enqueue(c, tx, rabbitmq.PlansQueue, models.PlanMessage{
+			Operation:   "create",
+			Plan:        plan,
+			Removed:     removedRefs(rootId, left),
+			Versions:    planVersions,
+			CommittedAt: commitTime(),
+		})
 		if err != nil {
-			return models.Plan{}, err
+			return err
 		}
 	}
-
-	existingPlan.Org = plan.Org
-	// existingPlan.PlanStatus = plan.PlanStatus
-	existingPlan.CreationDate = plan.CreationDate
-
-	if plan.ObjectId != "" && existingPlan.ObjectId != plan.ObjectId {
-		validationErr := errors.New("ObjectId mismatch in plan")
-		log.Errorf("Error updating plan : %v", validationErr)
-		return models.Plan{}, validationErr
-	}
-
-	value, err := json.Marshal(existingPlan)
-	if err != nil {
-		log.Printf("Error marshalling plan: %v", err)
-		return models.Plan{}, err
-	}
-
-	err = ps.repo.Set(ctx, key, string(value))
-	if err != nil {
-		log.Printf("Error saving plan to redis: %v", err)
-		return models.Plan{}, err
-	}
-
-	// FIXED: Use existingPlan instead of input plan for RabbitMQ message
-	message := models.PlanMessage{
-		Operation: "patch",
-		Plan:      existingPlan, // Changed from plan to existingPlan
-	}
-
-	rmq := &rabbitmq.Factory{}
-	err = rmq.PublishMessage("plans_queue", message)
-	if err != nil {
-		log.Errorf("Error publishing patch message to RabbitMQ: %v", err)
-		return models.Plan{}, err
-	}
-
-	return existingPlan, nil
-}
-
-func (ps *planService) UpdatePlan(ctx *gin.Context, key string, plan models.Plan) error {
-	// Delete the existing plan and all its associated objects
-	err := ps.DeletePlan(ctx, key)
-	if err != nil {
-		log.Printf("Failed to delete existing plan with error : %v", err.Error())
-		return err
-	}
-
-	// Create a new plan with the new request body
-	err = ps.CreatePlan(ctx, plan)
-	if err != nil {
-		log.Printf("Failed to create new plan with error : %v", err.Error())
-		return err
-	}
-
 	return nil
 }
 
-func (ps *planService) GetAllPlans(ctx *gin.Context) ([]models.Plan, error) {
-	plans := make([]models.Plan, 0)
-	keys, err := ps.repo.Keys(ctx, "*")
-	if err != nil {
-		log.Printf("Error fetching all the keys from the redis : %v", err)
-		return nil, err
-	}
-	for _, key := range keys {
-		value, err := ps.repo.Get(ctx, key)
-		if err != nil {
-			log.Printf("Error fetching the value from the redis : %v", err)
-			return nil, err
+// replaceObjects returns node with every object in changed replaced by its
+// new content, together with the ids of the objects whose content differs:
+// the replaced ones and everything above them. An object whose new content
+// is nil is left out, and dropped reports that for node itself. node is not
+// modified.
+func replaceObjects(node interface{}, changed map[string]map[string]interface{}) (value interface{}, updated []string, dropped bool) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		objectId, _ := n["objectId"].(string)
+		if content, ok := changed[objectId]; ok && objectId != "" {
+			if content == nil {
+				return nil, []string{objectId}, true
+			}
+			if reflect.DeepEqual(content, n) {
+				return n, nil, false
+			}
+			return content, []string{objectId}, false
 		}
 
-		var plan models.Plan
-		err = json.Unmarshal([]byte(value), &plan)
-		if err != nil {
-			log.Printf("Error unmarshalling the plan from the redis : %v", err)
-			continue
+		copied := make(map[string]interface{}, len(n))
+		for key, child := range n {
+			value, ids, dropped := replaceObjects(child, changed)
+			updated = append(updated, ids...)
+			if !dropped {
+				copied[key] = value
+			}
 		}
-
-		if plan.ObjectId != "" && plan.ObjectType != "" && plan.PlanCostShares.ObjectId != "" {
-			plans = append(plans, plan)
+		if len(updated) == 0 {
+			return n, nil, false
+		}
+		if objectId != "" {
+			updated = append(updated, objectId)
 		}
+		return copied, updated, false
+
+	case []interface{}:
+		copied := make([]interface{}, 0, len(n))
+		for _, child := range n {
+			value, ids, dropped := replaceObjects(child, changed)
+			updated = append(updated, ids...)
+			if !dropped {
+				copied = append(copied, value)
+			}
+		}
+		if len(updated) == 0 {
+			return n, nil, false
+		}
+		return copied, updated, false
 	}
-
-	return plans, nil
+	return node, nil, false
 }
 
-func (ps *planService) GetAnyObject(ctx *gin.Context, key string) (interface{}, error) {
-	value, err := ps.repo.Get(ctx, key)
-	if err != nil {
-		log.Printf("Error getting the plan from the redis : %v", err)
-		return nil, err
+// written maps every object of nodes to its content.
+func written(nodes []graph.Node) map[string]map[string]interface{} {
+	objects := make(map[string]map[string]interface{}, len(nodes))
+	for _, node := range nodes {
+		objects[node.ObjectId] = node.Document
 	}
+	return objects
+}
 
-	var plan models.Plan
-	err = json.Unmarshal([]byte(value), &plan)
-	if err != nil {
-		log.Printf("Error unmarshalling the plan from the redis : %v", err)
-		return nil, err
+// removedRefs addresses the index documents of objects that left the plan
+// rootId. Every plan has its own document of an object, so the object's
+// documents in other plans stay even when it is still stored.
+func removedRefs(rootId string, ids []string) []models.IndexRef {
+	refs := make([]models.IndexRef, 0, len(ids))
+	for _, id := range ids {
+		refs = append(refs, models.IndexRef{ID: id, Routing: rootId})
 	}
+	return refs
+}
 
-	// Check the ObjectType and return the corresponding struct
-	switch plan.ObjectType {
-	case "membercostshare":
-		var pcs models.PlanCostShares
-		err = json.Unmarshal([]byte(value), &pcs)
-		if err != nil {
-			return nil, err
-		}
-		return pcs, nil
-	case "service":
-		var ls models.LinkedService
-		err = json.Unmarshal([]byte(value), &ls)
-		if err != nil {
-			return nil, err
-		}
-		return ls, nil
-	case "PlanServiceCostShares":
-		var pscs models.PlanServiceCostShares
-		err = json.Unmarshal([]byte(value), &pscs)
-		if err != nil {
-			return nil, err
-		}
-		return pscs, nil
-	case "planservice":
-		var lps models.LinkedPlanService
-		err = json.Unmarshal([]byte(value), &lps)
-		if err != nil {
-			return nil, err
-		}
-		return lps, nil
-	default:
-		return plan, nil
+func nodeIds(nodes []graph.Node) []string {
+	ids := make([]string, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.ObjectId
 	}
+	return ids
+}
+
+func metaKey(objectId string) string {
+	return "meta:" + objectId
 }
@@ -0,0 +1,413 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"info7255-bigdata-app/database"
+	"info7255-bigdata-app/graph"
+	"info7255-bigdata-app/models"
+	"info7255-bigdata-app/repositories"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// racingRepo lets a write of its own commit between the reads and the
+// commit of the next Watch, like a concurrent request would.
+type racingRepo struct {
+	*database.MemoryRepository
+	race func()
+}
+
+func (r *racingRepo) Watch(ctx context.Context, fn func(watch func(keys ...string) error, tx repositories.RedisTx) error) error {
+	return r.MemoryRepository.Watch(ctx, func(watch func(keys ...string) error, tx repositories.RedisTx) error {
+		if err := fn(watch, tx); err != nil {
+			return err
+		}
+		if race := r.race; race != nil {
+			r.race = nil
+			race()
+		}
+		return nil
+	})
+}
+
+type testEnv struct {
+	c     *gin.Context
+	repo  *racingRepo
+	plans *planService
+	plan  map[string]interface{}
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	bundled, err := LoadBundledSchemas("../data")
+	if err != nil {
+		t.Fatalf("loading the bundled schemas: %v", err)
+	}
+	data, err := os.ReadFile("../data/plan.json")
+	if err != nil {
+		t.Fatalf("loading the sample plan: %v", err)
+	}
+	var plan map[string]interface{}
+	if err := json.Unmarshal(data, &plan); err != nil {
+		t.Fatalf("decoding the sample plan: %v", err)
+	}
+
+	repo := &racingRepo{MemoryRepository: database.NewMemoryRepository()}
+	schemas := NewSchemaService(repo, bundled)
+	plans := NewPlanService(repo, NewDocumentStore(repo), schemas, NewOutbox(repo, nil), nil).(*planService)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+
+	// Register the bundled schemas now, so their transactions are not the
+	// ones a test fails or races
+	if _, err := schemas.ValidateDocument(c, plan); err != nil {
+		t.Fatalf("validating the sample plan: %v", err)
+	}
+	return &testEnv{c: c, repo: repo, plans: plans, plan: plan}
+}
+
+func (env *testEnv) planId() string {
+	objectId, _, _ := graph.Identity(env.plan)
+	return objectId
+}
+
+// objectIds returns the ids of every object of the sample plan.
+func (env *testEnv) objectIds(t *testing.T) []string {
+	t.Helper()
+	nodes, err := graph.Split(env.plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nodeIds(nodes)
+}
+
+// keys returns every stored key but the outbox sequence, which is allocated
+// outside the transactions.
+func (env *testEnv) keys(t *testing.T) []string {
+	t.Helper()
+	all, err := env.repo.Keys(env.c, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(all))
+	for _, key := range all {
+		if key != outboxSequenceKey {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// messages returns the pending outbox messages, oldest first.
+func (env *testEnv) messages(t *testing.T) []models.PlanMessage {
+	t.Helper()
+	ids, err := env.repo.LRange(env.c, outboxPendingKey, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make([]models.PlanMessage, 0, len(ids))
+	for _, id := range ids {
+		value, err := env.repo.Get(env.c, outboxKey(id))
+		if err != nil {
+			t.Fatalf("outbox entry %s: %v", id, err)
+		}
+		var entry models.OutboxEntry
+		var message models.PlanMessage
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(entry.Payload, &message); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+func TestCreatePlanCommitsGraphAndMessage(t *testing.T) {
+	env := newTestEnv(t)
+	if err := env.plans.CreatePlan(env.c, env.plan, models.WriteOptions{}); err != nil {
+		t.Fatalf("CreatePlan: %v", err)
+	}
+
+	stored, err := env.plans.GetAnyObject(env.c, env.planId())
+	if err != nil {
+		t.Fatalf("GetAnyObject: %v", err)
+	}
+	if !reflect.DeepEqual(stored, env.plan) {
+		t.Errorf("stored plan = %v, want %v", stored, env.plan)
+	}
+
+	messages := env.messages(t)
+	if len(messages) != 1 || messages[0].Operation != "create" {
+		t.Fatalf("outbox = %+v, want one create", messages)
+	}
+	for _, id := range env.objectIds(t) {
+		if messages[0].Versions[id] <= 0 {
+			t.Errorf("the create message has no version for %s", id)
+		}
+	}
+}
+
+func TestFailedCommitWritesNothing(t *testing.T) {
+	failure := errors.New("connection reset")
+
+	t.Run("create", func(t *testing.T) {
+		env := newTestEnv(t)
+		before := env.keys(t)
+
+		env.repo.FailNextCommit(failure)
+		if err := env.plans.CreatePlan(env.c, env.plan, models.WriteOptions{}); err != failure {
+			t.Fatalf("CreatePlan = %v, want %v", err, failure)
+		}
+
+		if after := env.keys(t); !reflect.DeepEqual(after, before) {
+			t.Errorf("keys after the failed create = %v, want %v", after, before)
+		}
+		for _, id := range env.objectIds(t) {
+			if _, err := env.plans.GetAnyObject(env.c, id); err == nil {
+				t.Errorf("object %s was stored", id)
+			}
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		env := newTestEnv(t)
+		if err := env.plans.CreatePlan(env.c, env.plan, models.WriteOptions{}); err != nil {
+			t.Fatalf("CreatePlan: %v", err)
+		}
+		before := env.keys(t)
+
+		env.repo.FailNextCommit(failure)
+		if err := env.plans.DeletePlan(env.c, env.planId(), models.WriteOptions{}); err != failure {
+			t.Fatalf("DeletePlan = %v, want %v", err, failure)
+		}
+
+		if after := env.keys(t); !reflect.DeepEqual(after, before) {
+			t.Errorf("keys after the failed delete = %v, want %v", after, before)
+		}
+		stored, err := env.plans.GetAnyObject(env.c, env.planId())
+		if err != nil || !reflect.DeepEqual(stored, env.plan) {
+			t.Errorf("GetAnyObject after the failed delete = %v, %v, want the whole plan", stored, err)
+		}
+		if messages := env.messages(t); len(messages) != 1 {
+			t.Errorf("outbox = %+v, want only the create", messages)
+		}
+	})
+}
+
+func TestDeletePlanQueuesRemovedObjects(t *testing.T) {
+	env := newTestEnv(t)
+	if err := env.plans.CreatePlan(env.c, env.plan, models.WriteOptions{}); err != nil {
+		t.Fatalf("CreatePlan: %v", err)
+	}
+	if err := env.plans.DeletePlan(env.c, env.planId(), models.WriteOptions{}); err != nil {
+		t.Fatalf("DeletePlan: %v", err)
+	}
+
+	messages := env.messages(t)
+	if len(messages) != 2 || messages[1].Operation != "delete" {
+		t.Fatalf("outbox = %+v, want a create then a delete", messages)
+	}
+	removed := make(map[string]bool)
+	for _, ref := range messages[1].Removed {
+		removed[ref.ID] = true
+		if ref.Routing != env.planId() {
+			t.Errorf("%s is removed with routing %s, want %s", ref.ID, ref.Routing, env.planId())
+		}
+	}
+	for _, id := range env.objectIds(t) {
+		if !removed[id] {
+			t.Errorf("the delete message does not remove %s", id)
+		}
+		if messages[1].Versions[id] <= messages[0].Versions[id] {
+			t.Errorf("%s is deleted at version %d, not after its create at %d", id, messages[1].Versions[id], messages[0].Versions[id])
+		}
+		if _, err := env.plans.GetAnyObject(env.c, id); err == nil {
+			t.Errorf("object %s is still stored", id)
+		}
+	}
+}
+
+func TestConcurrentWriteConflicts(t *testing.T) {
+	env := newTestEnv(t)
+	if err := env.plans.CreatePlan(env.c, env.plan, models.WriteOptions{}); err != nil {
+		t.Fatalf("CreatePlan: %v", err)
+	}
+	ids := env.objectIds(t)
+	child := ids[len(ids)-1]
+
+	// A write through another plan bumps a shared child's version
+	race := func() {
+		if _, err := env.repo.Incr(env.c, versionKey(child)); err != nil {
+			t.Errorf("bumping the version of %s: %v", child, err)
+		}
+	}
+
+	t.Run("pinned", func(t *testing.T) {
+		versions, err := env.plans.GraphVersions(env.c, env.planId())
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := env.keys(t)
+		queued := len(env.messages(t))
+
+		env.repo.race = race
+		err = env.plans.UpdatePlan(env.c, env.planId(), env.plan, models.WriteOptions{IfVersions: versions})
+		if err == nil || err.Error() != "VERSION_CONFLICT" {
+			t.Fatalf("UpdatePlan = %v, want VERSION_CONFLICT", err)
+		}
+		if after := env.keys(t); !reflect.DeepEqual(after, before) {
+			t.Errorf("keys after the conflict = %v, want %v", after, before)
+		}
+		if messages := env.messages(t); len(messages) != queued {
+			t.Errorf("the conflicting update queued %d messages", len(messages)-queued)
+		}
+	})
+
+	t.Run("retried", func(t *testing.T) {
+		queued := len(env.messages(t))
+		current, err := env.plans.version(env.c, child)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env.repo.race = race
+		if err := env.plans.UpdatePlan(env.c, env.planId(), env.plan, models.WriteOptions{}); err != nil {
+			t.Fatalf("UpdatePlan: %v", err)
+		}
+		if env.repo.race != nil {
+			t.Fatal("the update never raced")
+		}
+
+		messages := env.messages(t)
+		if len(messages) != queued+1 {
+			t.Fatalf("the retried update queued %d messages, want 1", len(messages)-queued)
+		}
+		// The retry read the raced version, so it wrote past it
+		if got := messages[len(messages)-1].Versions[child]; got <= current+1 {
+			t.Errorf("update message version of %s = %d, want more than the raced %d", child, got, current+1)
+		}
+	})
+}
+
+func TestSharedChildrenLeaveOnlyThePlanIndex(t *testing.T) {
+	env := newTestEnv(t)
+	other := make(map[string]interface{}, len(env.plan))
+	for key, value := range env.plan {
+		other[key] = value
+	}
+	other["objectId"] = "other-plan"
+	other["planCostShares"] = map[string]interface{}{
+		"deductible": 500.0, "_org": "example.com", "copay": 10.0,
+		"objectId": "other-costshare", "objectType": "membercostshare",
+	}
+	for _, plan := range []map[string]interface{}{env.plan, other} {
+		if err := env.plans.CreatePlan(env.c, plan, models.WriteOptions{}); err != nil {
+			t.Fatalf("CreatePlan: %v", err)
+		}
+	}
+
+	if err := env.plans.DeletePlan(env.c, env.planId(), models.WriteOptions{}); err != nil {
+		t.Fatalf("DeletePlan: %v", err)
+	}
+	messages := env.messages(t)
+	removed := make(map[string]bool)
+	for _, ref := range messages[len(messages)-1].Removed {
+		if ref.Routing != env.planId() {
+			t.Errorf("%s is removed with routing %s, want %s", ref.ID, ref.Routing, env.planId())
+		}
+		removed[ref.ID] = true
+	}
+
+	// The shared linked plan services are still stored for the other plan,
+	// but the deleted plan's documents of them must go
+	for _, id := range env.objectIds(t) {
+		if !removed[id] {
+			t.Errorf("the delete message keeps the deleted plan's document of %s", id)
+		}
+	}
+	stored, err := env.plans.GetAnyObject(env.c, "other-plan")
+	if err != nil || !reflect.DeepEqual(stored, other) {
+		t.Errorf("GetAnyObject(other-plan) = %v, %v, want the whole plan", stored, err)
+	}
+}
+
+func TestSharedChildChangeReindexesOtherPlans(t *testing.T) {
+	env := newTestEnv(t)
+	other := deepCopy(t, env.plan)
+	other["objectId"] = "other-plan"
+	other["planCostShares"] = map[string]interface{}{
+		"deductible": 500.0, "_org": "example.com", "copay": 10.0,
+		"objectId": "other-costshare", "objectType": "membercostshare",
+	}
+	for _, plan := range []map[string]interface{}{env.plan, other} {
+		if err := env.plans.CreatePlan(env.c, plan, models.WriteOptions{}); err != nil {
+			t.Fatalf("CreatePlan: %v", err)
+		}
+	}
+	created := env.messages(t)[1]
+
+	// Rename a linked service both plans share through the first plan only
+	updated := deepCopy(t, env.plan)
+	service := updated["linkedPlanServices"].([]interface{})[0].(map[string]interface{})["linkedService"].(map[string]interface{})
+	service["name"] = "Yearly checkup"
+	serviceId := service["objectId"].(string)
+	if err := env.plans.UpdatePlan(env.c, env.planId(), updated, models.WriteOptions{}); err != nil {
+		t.Fatalf("UpdatePlan: %v", err)
+	}
+
+	messages := env.messages(t)
+	if len(messages) != 4 {
+		t.Fatalf("outbox = %+v, want the update followed by a create of other-plan", messages[2:])
+	}
+	update, refresh := messages[2], messages[3]
+	if refresh.Operation != "create" || refresh.Plan["objectId"] != "other-plan" {
+		t.Fatalf("second message = %+v, want a create of other-plan", refresh)
+	}
+
+	// The message holds other-plan as it is stored after the commit
+	stored, err := env.plans.GetAnyObject(env.c, "other-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(refresh.Plan, stored) {
+		t.Errorf("queued other-plan = %v, want the stored %v", refresh.Plan, stored)
+	}
+	if got := refresh.Versions[serviceId]; got != update.Versions[serviceId] {
+		t.Errorf("version of %s = %d, want %d as in the update", serviceId, got, update.Versions[serviceId])
+	}
+	// Documents nesting the service change too, the others stay as indexed
+	if refresh.Versions["other-plan"] <= created.Versions["other-plan"] {
+		t.Errorf("other-plan is reindexed at version %d, not after %d", refresh.Versions["other-plan"], created.Versions["other-plan"])
+	}
+	if got, want := refresh.Versions["other-costshare"], created.Versions["other-costshare"]; got != want {
+		t.Errorf("version of the untouched other-costshare = %d, want %d", got, want)
+	}
+	versions, err := env.plans.GraphVersions(env.c, "other-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(versions, refresh.Versions) {
+		t.Errorf("stored versions of other-plan = %v, want the queued %v", versions, refresh.Versions)
+	}
+}
+
+// deepCopy returns a copy of doc that shares nothing with it.
+func deepCopy(t *testing.T, doc map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copied map[string]interface{}
+	if err := json.Unmarshal(data, &copied); err != nil {
+		t.Fatal(err)
+	}
+	return copied
+}
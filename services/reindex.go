@@ -0,0 +1,214 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"info7255-bigdata-app/models"
+	"info7255-bigdata-app/rabbitmq"
+	"info7255-bigdata-app/repositories"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	reindexJobKey = "reindex:job"
+
+	// reindexBatchSize is how many plans are queued, and checkpointed, per
+	// transaction.
+	reindexBatchSize = 50
+
+	ReindexRunning   = "running"
+	ReindexCompleted = "completed"
+	ReindexFailed    = "failed"
+)
+
+// ReindexService rebuilds the search index from Redis by replaying every plan
+// as a create message through the outbox. The checkpoint is written in the
+// same transaction as the messages, so a resumed job neither skips nor
+// repeats a plan.
+type ReindexService interface {
+	// Start runs a job in the background. An unfinished job is resumed from
+	// its checkpoint unless restart is set.
+	Start(c *gin.Context, restart bool) (models.ReindexJob, error)
+	Status(c *gin.Context) (models.ReindexJob, error)
+}
+
+type reindexService struct {
+	repo   repositories.RedisRepo
+	plans  PlanService
+	outbox Outbox
+
+	mu      sync.Mutex
+	running bool
+}
+
+func NewReindexService(repo repositories.RedisRepo, plans PlanService, outbox Outbox) ReindexService {
+	return &reindexService{
+		repo:   repo,
+		plans:  plans,
+		outbox: outbox,
+	}
+}
+
+func (rs *reindexService) Start(c *gin.Context, restart bool) (models.ReindexJob, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.running {
+		return models.ReindexJob{}, errors.New("REINDEX_RUNNING")
+	}
+
+	job, err := rs.Status(c)
+	if err != nil && err.Error() != "KEY_NOT_FOUND" {
+		return models.ReindexJob{}, err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	if err != nil || restart || job.Status == ReindexCompleted {
+		job = models.ReindexJob{
+			ID:        strconv.FormatInt(time.Now().UnixNano(), 36),
+			StartedAt: now,
+		}
+	} else {
+		log.Printf("Resuming reindex %s after plan %q", job.ID, job.LastObjectId)
+	}
+
+	ids, err := rs.plans.ListPlanIds(c)
+	if err != nil {
+		return models.ReindexJob{}, err
+	}
+
+	// Plans created since the checkpoint still sort in; only ids after it
+	// are left to do.
+	remaining := ids[sort.SearchStrings(ids, job.LastObjectId):]
+	if len(remaining) > 0 && remaining[0] == job.LastObjectId {
+		remaining = remaining[1:]
+	}
+
+	job.Status = ReindexRunning
+	job.Error = ""
+	job.FinishedAt = ""
+	job.Total = job.Processed + job.Skipped + len(remaining)
+	job.UpdatedAt = now
+	if err := rs.save(c, job); err != nil {
+		return models.ReindexJob{}, err
+	}
+
+	rs.running = true
+	go rs.run(c.Copy(), job, remaining)
+	return job, nil
+}
+
+func (rs *reindexService) Status(c *gin.Context) (models.ReindexJob, error) {
+	value, err := rs.repo.Get(c, reindexJobKey)
+	if err != nil {
+		return models.ReindexJob{}, err
+	}
+
+	var job models.ReindexJob
+	if err := json.Unmarshal([]byte(value), &job); err != nil {
+		log.Printf("Error unmarshalling the reindex job : %v", err)
+		return models.ReindexJob{}, err
+	}
+	return job, nil
+}
+
+func (rs *reindexService) run(c *gin.Context, job models.ReindexJob, ids []string) {
+	defer func() {
+		rs.mu.Lock()
+		rs.running = false
+		rs.mu.Unlock()
+	}()
+
+	for start := 0; start < len(ids); start += reindexBatchSize {
+		end := start + reindexBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		next, err := rs.queueBatch(c, job, ids[start:end])
+		if err != nil {
+			log.Errorf("Reindex %s failed after plan %q : %v", job.ID, job.LastObjectId, err)
+			job.Status = ReindexFailed
+			job.Error = err.Error()
+			job.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+			if err := rs.save(c, job); err != nil {
+				log.Printf("Error saving the reindex job : %v", err)
+			}
+			return
+		}
+		job = next
+		rs.outbox.Notify()
+		log.Printf("Reindex %s queued %d of %d plans", job.ID, job.Processed+job.Skipped, job.Total)
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	job.Status = ReindexCompleted
+	job.UpdatedAt = now
+	job.FinishedAt = now
+	if err := rs.save(c, job); err != nil {
+		log.Printf("Error saving the reindex job : %v", err)
+	}
+}
+
+// queueBatch queues a create message for each plan in ids and advances the
+// checkpoint in the same transaction. It returns the job as committed.
+func (rs *reindexService) queueBatch(c *gin.Context, job models.ReindexJob, ids []string) (models.ReindexJob, error) {
+	plans := make([]map[string]interface{}, 0, len(ids))
+	versions := make([]map[string]int64, 0, len(ids))
+	for _, id := range ids {
+		// The versions must be the ones the plan was read at, or a message
+		// carrying a newer version could undo a delete that followed
+		plan, planVersions, err := rs.plans.GetVersioned(c, id)
+		if err != nil {
+			if err.Error() == "KEY_NOT_FOUND" {
+				// Deleted since the job started; its delete message
+				// already took care of the index
+				job.Skipped++
+				continue
+			}
+			return job, err
+		}
+		plans = append(plans, plan)
+		versions = append(versions, planVersions)
+	}
+
+	job.Processed += len(plans)
+	job.LastObjectId = ids[len(ids)-1]
+	job.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	value, err := json.Marshal(job)
+	if err != nil {
+		return job, err
+	}
+
+	err = rs.repo.Batch(c, func(tx repositories.RedisTx) error {
+		for i, plan := range plans {
+			err := rs.outbox.Enqueue(c, tx, rabbitmq.PlansQueue, models.PlanMessage{
+				Operation:   "create",
+				Plan:        plan,
+				Versions:    versions[i],
+				CommittedAt: commitTime(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		tx.Set(reindexJobKey, string(value))
+		return nil
+	})
+	return job, err
+}
+
+func (rs *reindexService) save(c *gin.Context, job models.ReindexJob) error {
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return rs.repo.Set(c, reindexJobKey, string(value))
+}
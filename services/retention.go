@@ -0,0 +1,238 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"info7255-bigdata-app/models"
+	"info7255-bigdata-app/repositories"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A plan with a retention keeps its deadline in two keys:
+//
+//	retention:{objectId}   the deadline, never expires; swept periodically
+//	expires:{objectId}     a sentinel that expires at the deadline, so the
+//	                       expired key event deletes the plan right away
+//
+// The plan itself never expires. It is deleted through DeletePlan like any
+// other plan, which also queues the deletion for the search index.
+const (
+	retentionPrefix = "retention:"
+	expiresPrefix   = "expires:"
+
+	expirerMinBackoff = time.Second
+	expirerMaxBackoff = time.Minute
+)
+
+// RetentionPolicy maps an objectType to how long its documents are kept.
+// Types without an entry are kept forever. Only whole plans expire, so plan
+// is the only type it can hold.
+type RetentionPolicy map[string]time.Duration
+
+// ParseRetentionPolicy reads a policy like "plan=720h" or "plan=30d". Objects
+// below a plan go with it, so any other objectType is rejected.
+func ParseRetentionPolicy(value string) (RetentionPolicy, error) {
+	policy := make(RetentionPolicy)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		objectType, retention, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(objectType) == "" {
+			return nil, fmt.Errorf("retention policy entry %q is not objectType=duration", entry)
+		}
+		objectType = strings.TrimSpace(objectType)
+		if objectType != "plan" {
+			return nil, fmt.Errorf("retention policy entry %q: only plans expire, %s objects go with their plan", entry, objectType)
+		}
+		d, err := ParseRetention(retention)
+		if err != nil {
+			return nil, fmt.Errorf("retention of %s: %w", objectType, err)
+		}
+		policy[objectType] = d
+	}
+	return policy, nil
+}
+
+// ParseRetention reads a retention such as "720h" or "30d". "none" and "0"
+// mean forever and return zero.
+func ParseRetention(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "none" || value == "0" {
+		return 0, nil
+	}
+
+	var d time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid retention %q", value)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(value); err != nil {
+			return 0, fmt.Errorf("invalid retention %q", value)
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("retention %q must be positive", value)
+	}
+	return d, nil
+}
+
+// retain queues the retention of the plan objectId. Without an explicit
+// retention, create and update apply the policy of objectType while a patch
+// keeps the current deadline.
+func (ps *planService) retain(tx repositories.RedisTx, objectId, objectType string, opts models.WriteOptions, patch bool) {
+	var retention time.Duration
+	switch {
+	case opts.Retention != nil:
+		retention = *opts.Retention
+	case patch:
+		return
+	default:
+		retention = ps.retention[objectType]
+	}
+
+	if retention <= 0 {
+		tx.Delete(retentionKey(objectId), expiresKey(objectId))
+		return
+	}
+	deadline := time.Now().Add(retention).UTC().Format(time.RFC3339)
+	tx.Set(retentionKey(objectId), deadline)
+	tx.SetEx(expiresKey(objectId), deadline, retention)
+}
+
+// Expirer deletes plans once their retention has run out.
+type Expirer interface {
+	// Run listens for expired sentinels and sweeps for deadlines it missed,
+	// e.g. while the API was down, until ctx is done.
+	Run(ctx context.Context)
+}
+
+type expirer struct {
+	repo          repositories.RedisRepo
+	plans         PlanService
+	sweepInterval time.Duration
+}
+
+func NewExpirer(repo repositories.RedisRepo, plans PlanService, sweepInterval time.Duration) Expirer {
+	return &expirer{
+		repo:          repo,
+		plans:         plans,
+		sweepInterval: sweepInterval,
+	}
+}
+
+func (e *expirer) Run(ctx context.Context) {
+	go e.listen(ctx)
+
+	ticker := time.NewTicker(e.sweepInterval)
+	defer ticker.Stop()
+	for {
+		e.sweep(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *expirer) listen(ctx context.Context) {
+	backoff := expirerMinBackoff
+	for {
+		err := e.repo.SubscribeExpired(ctx, func(key string) {
+			backoff = expirerMinBackoff
+			if objectId, ok := strings.CutPrefix(key, expiresPrefix); ok {
+				e.expire(ctx, objectId)
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Errorf("Lost the expired key subscription, retrying in %s : %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > expirerMaxBackoff {
+			backoff = expirerMaxBackoff
+		}
+	}
+}
+
+// sweep expires every plan whose deadline has passed.
+func (e *expirer) sweep(ctx context.Context) {
+	keys, err := e.repo.Keys(ctx, retentionPrefix+"*")
+	if err != nil {
+		log.Errorf("Error listing the plan retentions : %v", err)
+		return
+	}
+	for _, key := range keys {
+		e.expire(ctx, strings.TrimPrefix(key, retentionPrefix))
+	}
+}
+
+// expire deletes the plan objectId if its deadline has passed. The deadline
+// is checked again because the retention may have been extended since, and
+// the plan is only deleted if it has not been written after that check.
+func (e *expirer) expire(ctx context.Context, objectId string) {
+	versions, err := e.plans.GraphVersions(&gin.Context{}, objectId)
+	if err != nil {
+		log.Errorf("Error reading the versions of %s : %v", objectId, err)
+		return
+	}
+	value, err := e.repo.Get(ctx, retentionKey(objectId))
+	if err != nil {
+		if err.Error() != "KEY_NOT_FOUND" {
+			log.Errorf("Error reading the retention of %s : %v", objectId, err)
+		}
+		return
+	}
+	deadline, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Errorf("Invalid retention deadline %q of %s : %v", value, objectId, err)
+		return
+	}
+	if time.Now().Before(deadline) {
+		return
+	}
+
+	if err := e.plans.DeletePlan(&gin.Context{}, objectId, models.WriteOptions{IfVersions: versions}); err != nil {
+		if err.Error() == "VERSION_CONFLICT" {
+			// Written since; the next sweep checks the deadline again
+			log.Printf("Plan %s was written while it expired, leaving it to the next sweep", objectId)
+			return
+		}
+		if err.Error() == "KEY_NOT_FOUND" {
+			// Already gone; only the deadline is left
+			e.repo.Batch(ctx, func(tx repositories.RedisTx) error {
+				tx.Delete(retentionKey(objectId), expiresKey(objectId))
+				return nil
+			})
+			return
+		}
+		log.Errorf("Error deleting expired plan %s : %v", objectId, err)
+		return
+	}
+	log.Printf("Deleted plan %s whose retention ran out at %s", objectId, value)
+}
+
+func retentionKey(objectId string) string {
+	return retentionPrefix + objectId
+}
+
+func expiresKey(objectId string) string {
+	return expiresPrefix + objectId
+}
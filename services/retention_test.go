@@ -0,0 +1,35 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	tests := []struct {
+		value string
+		want  RetentionPolicy
+	}{
+		{"", RetentionPolicy{}},
+		{"plan=720h", RetentionPolicy{"plan": 720 * time.Hour}},
+		{" plan = 30d ,", RetentionPolicy{"plan": 30 * 24 * time.Hour}},
+		{"plan=none", RetentionPolicy{"plan": 0}},
+	}
+	for _, tt := range tests {
+		got, err := ParseRetentionPolicy(tt.value)
+		if err != nil {
+			t.Errorf("ParseRetentionPolicy(%q): %v", tt.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRetentionPolicy(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"plan", "=30d", "plan=soon", "plan=-1h", "service=30d", "plan=720h,membercostshare=1d"} {
+		if _, err := ParseRetentionPolicy(value); err == nil {
+			t.Errorf("ParseRetentionPolicy(%q) accepted the policy", value)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"info7255-bigdata-app/models"
+	"info7255-bigdata-app/repositories"
+	"info7255-bigdata-app/schema"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SchemaObjectTypes lists the object types a schema can be registered for.
+var SchemaObjectTypes = []string{"plan", "planservice", "membercostshare", "service"}
+
+// LoadBundledSchemas reads the bundled schema of every objectType from
+// {dir}/{objectType}-schema.json.
+func LoadBundledSchemas(dir string) (map[string]*schema.Schema, error) {
+	bundled := make(map[string]*schema.Schema, len(SchemaObjectTypes))
+	for _, objectType := range SchemaObjectTypes {
+		compiled, err := schema.LoadFile(filepath.Join(dir, objectType+"-schema.json"))
+		if err != nil {
+			return nil, fmt.Errorf("loading the %s schema: %w", objectType, err)
+		}
+		bundled[objectType] = compiled
+	}
+	return bundled, nil
+}
+
+type SchemaService interface {
+	CreateSchema(c *gin.Context, objectType string, body []byte, activate bool) (models.SchemaVersion, error)
+	GetSchema(c *gin.Context, objectType string, version int) (models.SchemaVersion, error)
+	GetActiveSchema(c *gin.Context, objectType string) (models.SchemaVersion, error)
+	ListVersions(c *gin.Context, objectType string) ([]models.SchemaVersion, error)
+	ListSchemas(c *gin.Context) ([]models.SchemaSummary, error)
+	ActivateSchema(c *gin.Context, objectType string, version int) error
+	Validate(c *gin.Context, objectType string, doc interface{}, partial bool) (int, error)
+	ValidateDocument(c *gin.Context, doc interface{}) (map[string]models.ObjectMeta, error)
+}
+
+type schemaService struct {
+	repo     repositories.RedisRepo
+	defaults map[string]*schema.Schema
+
+	mu       sync.Mutex
+	compiled map[string]*schema.Schema
+}
+
+// NewSchemaService creates a registry backed by repo. defaults are bundled
+// schemas that get registered as version 1 the first time an objectType
+// without any stored version is used.
+func NewSchemaService(repo repositories.RedisRepo, defaults map[string]*schema.Schema) SchemaService {
+	return &schemaService{
+		repo:     repo,
+		defaults: defaults,
+		compiled: make(map[string]*schema.Schema),
+	}
+}
+
+func (ss *schemaService) CreateSchema(c *gin.Context, objectType string, body []byte, activate bool) (models.SchemaVersion, error) {
+	if !isSchemaObjectType(objectType) {
+		return models.SchemaVersion{}, errors.New("UNKNOWN_OBJECT_TYPE")
+	}
+
+	compiled, err := schema.Parse(body)
+	if err != nil {
+		log.Printf("Error parsing the %s schema : %v", objectType, err)
+		return models.SchemaVersion{}, fmt.Errorf("INVALID_SCHEMA: %w", err)
+	}
+
+	next, err := ss.repo.Incr(c, schemaKey(objectType, "latest"))
+	if err != nil {
+		log.Printf("Error allocating a schema version in redis : %v", err)
+		return models.SchemaVersion{}, err
+	}
+
+	version := models.SchemaVersion{
+		ObjectType: objectType,
+		Version:    int(next),
+		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
+		Schema:     json.RawMessage(body),
+	}
+	value, err := json.Marshal(version)
+	if err != nil {
+		log.Errorf("Error marshalling the schema version : %v", err)
+		return models.SchemaVersion{}, err
+	}
+	if err := ss.repo.Set(c, schemaKey(objectType, "v"+strconv.Itoa(version.Version)), string(value)); err != nil {
+		log.Printf("Error setting the schema in the redis : %v", err)
+		return models.SchemaVersion{}, err
+	}
+	ss.remember(objectType, version.Version, compiled)
+
+	if activate {
+		if err := ss.repo.Set(c, schemaKey(objectType, "active"), strconv.Itoa(version.Version)); err != nil {
+			log.Printf("Error activating the schema in the redis : %v", err)
+			return models.SchemaVersion{}, err
+		}
+		version.Active = true
+	}
+
+	return version, nil
+}
+
+func (ss *schemaService) GetSchema(c *gin.Context, objectType string, version int) (models.SchemaVersion, error) {
+	if !isSchemaObjectType(objectType) {
+		return models.SchemaVersion{}, errors.New("UNKNOWN_OBJECT_TYPE")
+	}
+
+	value, err := ss.repo.Get(c, schemaKey(objectType, "v"+strconv.Itoa(version)))
+	if err != nil {
+		return models.SchemaVersion{}, err
+	}
+
+	var sv models.SchemaVersion
+	if err := json.Unmarshal([]byte(value), &sv); err != nil {
+		log.Printf("Error unmarshalling the schema from redis : %v", err)
+		return models.SchemaVersion{}, err
+	}
+
+	active, err := ss.activeVersion(c, objectType)
+	if err != nil && err.Error() != "KEY_NOT_FOUND" {
+		return models.SchemaVersion{}, err
+	}
+	sv.Active = active == sv.Version
+	return sv, nil
+}
+
+func (ss *schemaService) GetActiveSchema(c *gin.Context, objectType string) (models.SchemaVersion, error) {
+	version, _, err := ss.active(c, objectType)
+	if err != nil {
+		return models.SchemaVersion{}, err
+	}
+	return ss.GetSchema(c, objectType, version)
+}
+
+func (ss *schemaService) ListVersions(c *gin.Context, objectType string) ([]models.SchemaVersion, error) {
+	if !isSchemaObjectType(objectType) {
+		return nil, errors.New("UNKNOWN_OBJECT_TYPE")
+	}
+
+	latest, err := ss.latestVersion(c, objectType)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]models.SchemaVersion, 0, latest)
+	for v := 1; v <= latest; v++ {
+		sv, err := ss.GetSchema(c, objectType, v)
+		if err != nil {
+			if err.Error() == "KEY_NOT_FOUND" {
+				continue
+			}
+			return nil, err
+		}
+		sv.Schema = nil
+		versions = append(versions, sv)
+	}
+	return versions, nil
+}
+
+func (ss *schemaService) ListSchemas(c *gin.Context) ([]models.SchemaSummary, error) {
+	summaries := make([]models.SchemaSummary, 0, len(SchemaObjectTypes))
+	for _, objectType := range SchemaObjectTypes {
+		latest, err := ss.latestVersion(c, objectType)
+		if err != nil {
+			if err.Error() == "KEY_NOT_FOUND" {
+				continue
+			}
+			return nil, err
+		}
+
+		active, err := ss.activeVersion(c, objectType)
+		if err != nil && err.Error() != "KEY_NOT_FOUND" {
+			return nil, err
+		}
+
+		summaries = append(summaries, models.SchemaSummary{
+			ObjectType:    objectType,
+			ActiveVersion: active,
+			LatestVersion: latest,
+		})
+	}
+	return summaries, nil
+}
+
+func (ss *schemaService) ActivateSchema(c *gin.Context, objectType string, version int) error {
+	if _, err := ss.GetSchema(c, objectType, version); err != nil {
+		return err
+	}
+	return ss.repo.Set(c, schemaKey(objectType, "active"), strconv.Itoa(version))
+}
+
+// Validate checks doc against the active schema of objectType and returns the
+// version it was checked with. Rule failures are returned as
+// *schema.ValidationError, and so is an objectType without an active schema,
+// since nothing can vouch for such a document.
+func (ss *schemaService) Validate(c *gin.Context, objectType string, doc interface{}, partial bool) (int, error) {
+	version, compiled, err := ss.active(c, objectType)
+	if err != nil {
+		if err.Error() == "KEY_NOT_FOUND" || err.Error() == "UNKNOWN_OBJECT_TYPE" {
+			return 0, &schema.ValidationError{Violations: []schema.Violation{{
+				Path:    "/objectType",
+				Rule:    "schema",
+				Message: fmt.Sprintf("no schema is active for objectType %q", objectType),
+			}}}
+		}
+		return 0, err
+	}
+
+	var violations []schema.Violation
+	if partial {
+		violations = compiled.ValidatePartial(doc)
+	} else {
+		violations = compiled.Validate(doc)
+	}
+	if len(violations) > 0 {
+		return version, &schema.ValidationError{Violations: violations}
+	}
+	return version, nil
+}
+
+// ValidateDocument validates a whole plan: doc must be an object of type
+// plan, and it and every nested object carrying an objectType must pass that
+// type's active schema. It returns the metadata to record for each objectId
+// in the document.
+func (ss *schemaService) ValidateDocument(c *gin.Context, doc interface{}) (map[string]models.ObjectMeta, error) {
+	metas := make(map[string]models.ObjectMeta)
+	var violations []schema.Violation
+
+	if root, ok := doc.(map[string]interface{}); !ok || root["objectType"] != "plan" {
+		violations = append(violations, schema.Violation{
+			Path:    "/objectType",
+			Rule:    "const",
+			Message: `the root object must have objectType "plan"`,
+		})
+	}
+
+	var walk func(node interface{}, path string) error
+	walk = func(node interface{}, path string) error {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			objectType, _ := n["objectType"].(string)
+			objectId, _ := n["objectId"].(string)
+			if objectType != "" {
+				version, err := ss.Validate(c, objectType, n, false)
+				var validationErr *schema.ValidationError
+				if errors.As(err, &validationErr) {
+					for _, v := range validationErr.Violations {
+						v.Path = path + v.Path
+						violations = append(violations, v)
+					}
+				} else if err != nil {
+					return err
+				}
+				if objectId != "" {
+					metas[objectId] = models.ObjectMeta{ObjectType: objectType, SchemaVersion: version}
+				}
+			}
+			for key, child := range n {
+				if err := walk(child, path+"/"+escapePointer(key)); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for i, child := range n {
+				if err := walk(child, path+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := walk(doc, ""); err != nil {
+		return nil, err
+	}
+	if len(violations) > 0 {
+		sort.SliceStable(violations, func(i, j int) bool {
+			return violations[i].Path < violations[j].Path
+		})
+		return nil, &schema.ValidationError{Violations: dedupeViolations(violations)}
+	}
+	return metas, nil
+}
+
+// active returns the active version of objectType and its compiled schema,
+// registering the bundled default when nothing is stored yet.
+func (ss *schemaService) active(c *gin.Context, objectType string) (int, *schema.Schema, error) {
+	if !isSchemaObjectType(objectType) {
+		return 0, nil, errors.New("UNKNOWN_OBJECT_TYPE")
+	}
+
+	version, err := ss.activeVersion(c, objectType)
+	if err != nil && err.Error() == "KEY_NOT_FOUND" {
+		bundled, ok := ss.defaults[objectType]
+		if !ok {
+			return 0, nil, err
+		}
+		version, err = ss.registerDefault(c, objectType, bundled)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if compiled := ss.lookup(objectType, version); compiled != nil {
+		return version, compiled, nil
+	}
+
+	sv, err := ss.GetSchema(c, objectType, version)
+	if err != nil {
+		return 0, nil, err
+	}
+	compiled, err := schema.Parse(sv.Schema)
+	if err != nil {
+		log.Errorf("Stored %s schema v%d no longer parses : %v", objectType, version, err)
+		return 0, nil, err
+	}
+	ss.remember(objectType, version, compiled)
+	return version, compiled, nil
+}
+
+// registerDefault stores and activates the bundled schema of objectType
+// unless some version is active already, and returns the active version.
+// The check and the writes are one transaction, so concurrent first
+// requests register it once and all end up with the same version.
+func (ss *schemaService) registerDefault(c *gin.Context, objectType string, bundled *schema.Schema) (int, error) {
+	activeKey := schemaKey(objectType, "active")
+	latestKey := schemaKey(objectType, "latest")
+	for attempt := 1; ; attempt++ {
+		active := 0
+		err := ss.repo.Watch(c, func(watch func(keys ...string) error, tx repositories.RedisTx) error {
+			// CreateSchema raises latest, so an upload in between is seen too
+			if err := watch(activeKey, latestKey); err != nil {
+				return err
+			}
+			current, err := ss.activeVersion(c, objectType)
+			if err == nil {
+				active = current
+				return nil
+			}
+			if err.Error() != "KEY_NOT_FOUND" {
+				return err
+			}
+			latest, err := ss.latestVersion(c, objectType)
+			if err != nil && err.Error() != "KEY_NOT_FOUND" {
+				return err
+			}
+
+			active = latest + 1
+			value, err := json.Marshal(models.SchemaVersion{
+				ObjectType: objectType,
+				Version:    active,
+				CreatedAt:  time.Now().UTC().Format(time.RFC3339),
+				Schema:     json.RawMessage(bundled.Raw()),
+			})
+			if err != nil {
+				return err
+			}
+			log.Printf("Registering the bundled %s schema as v%d", objectType, active)
+			tx.Set(schemaKey(objectType, "v"+strconv.Itoa(active)), string(value))
+			tx.Set(latestKey, strconv.Itoa(active))
+			tx.Set(activeKey, strconv.Itoa(active))
+			return nil
+		})
+		if err == nil {
+			return active, nil
+		}
+		if err.Error() != "TX_CONFLICT" || attempt == writeAttempts {
+			log.Printf("Error registering the bundled %s schema : %v", objectType, err)
+			return 0, err
+		}
+	}
+}
+
+func (ss *schemaService) activeVersion(c *gin.Context, objectType string) (int, error) {
+	value, err := ss.repo.Get(c, schemaKey(objectType, "active"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+func (ss *schemaService) latestVersion(c *gin.Context, objectType string) (int, error) {
+	value, err := ss.repo.Get(c, schemaKey(objectType, "latest"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+func (ss *schemaService) lookup(objectType string, version int) *schema.Schema {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.compiled[objectType+":"+strconv.Itoa(version)]
+}
+
+func (ss *schemaService) remember(objectType string, version int, compiled *schema.Schema) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.compiled[objectType+":"+strconv.Itoa(version)] = compiled
+}
+
+func schemaKey(objectType, suffix string) string {
+	return "schema:" + objectType + ":" + suffix
+}
+
+func isSchemaObjectType(objectType string) bool {
+	for _, t := range SchemaObjectTypes {
+		if t == objectType {
+			return true
+		}
+	}
+	return false
+}
+
+func escapePointer(token string) string {
+	token = strings.ReplaceAll(token, "~", "~0")
+	return strings.ReplaceAll(token, "/", "~1")
+}
+
+// dedupeViolations drops repeats that show up when a nested object is checked
+// both by its parent's schema and by its own.
+func dedupeViolations(violations []schema.Violation) []schema.Violation {
+	seen := make(map[schema.Violation]bool, len(violations))
+	unique := violations[:0]
+	for _, v := range violations {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
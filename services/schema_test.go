@@ -0,0 +1,96 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"info7255-bigdata-app/database"
+	"info7255-bigdata-app/graph"
+	"info7255-bigdata-app/schema"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func loadSamplePlan(t *testing.T) map[string]interface{} {
+	t.Helper()
+	data, err := os.ReadFile("../data/plan.json")
+	if err != nil {
+		t.Fatalf("loading the sample plan: %v", err)
+	}
+	var plan map[string]interface{}
+	if err := json.Unmarshal(data, &plan); err != nil {
+		t.Fatalf("decoding the sample plan: %v", err)
+	}
+	return plan
+}
+
+// violations returns the violations err carries, failing the test if err is
+// not a validation error.
+func violations(t *testing.T, err error) []schema.Violation {
+	t.Helper()
+	var validationErr *schema.ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("error = %v, want a validation error", err)
+	}
+	return validationErr.Violations
+}
+
+func TestValidateDocument(t *testing.T) {
+	bundled, err := LoadBundledSchemas("../data")
+	if err != nil {
+		t.Fatalf("loading the bundled schemas: %v", err)
+	}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+
+	t.Run("sample plan", func(t *testing.T) {
+		schemas := NewSchemaService(database.NewMemoryRepository(), bundled)
+		plan := loadSamplePlan(t)
+		metas, err := schemas.ValidateDocument(c, plan)
+		if err != nil {
+			t.Fatalf("ValidateDocument: %v", err)
+		}
+		nodes, err := graph.Split(plan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, node := range nodes {
+			if meta := metas[node.ObjectId]; meta.ObjectType != node.ObjectType || meta.SchemaVersion != 1 {
+				t.Errorf("meta of %s = %+v, want %s at schema version 1", node.ObjectId, meta, node.ObjectType)
+			}
+		}
+	})
+
+	t.Run("root is not a plan", func(t *testing.T) {
+		schemas := NewSchemaService(database.NewMemoryRepository(), bundled)
+		plan := loadSamplePlan(t)
+		service := plan["linkedPlanServices"].([]interface{})[0].(map[string]interface{})["linkedService"]
+		_, err := schemas.ValidateDocument(c, service)
+		if got := violations(t, err); got[0].Path != "/objectType" || got[0].Rule != "const" {
+			t.Errorf("violations = %+v, want the root objectType rejected", got)
+		}
+	})
+
+	t.Run("unknown nested type", func(t *testing.T) {
+		schemas := NewSchemaService(database.NewMemoryRepository(), bundled)
+		plan := loadSamplePlan(t)
+		plan["planCostShares"].(map[string]interface{})["objectType"] = "discount"
+		_, err := schemas.ValidateDocument(c, plan)
+		found := false
+		for _, v := range violations(t, err) {
+			found = found || (v.Path == "/planCostShares/objectType" && v.Rule == "schema")
+		}
+		if !found {
+			t.Errorf("the unknown objectType at /planCostShares passed validation")
+		}
+	})
+
+	t.Run("type without an active schema", func(t *testing.T) {
+		schemas := NewSchemaService(database.NewMemoryRepository(), map[string]*schema.Schema{"plan": bundled["plan"]})
+		_, err := schemas.ValidateDocument(c, loadSamplePlan(t))
+		if got := violations(t, err); len(got) == 0 || got[0].Rule != "schema" {
+			t.Errorf("violations = %+v, want the types without a schema rejected", got)
+		}
+	})
+}
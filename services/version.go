@@ -0,0 +1,254 @@
+package services
+
+import (
+	"errors"
+	"info7255-bigdata-app/graph"
+	"info7255-bigdata-app/repositories"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gin-gonic/gin"
+)
+
+// writeAttempts is how often a write without expected versions is retried
+// when a concurrent write to the same plan commits first. It also bounds
+// how often GetVersioned reads a plan that keeps changing.
+const writeAttempts = 5
+
+// Every object has a version at version:{objectId} that goes up with each
+// write touching it, deletes included. A write touches the objects it
+// stores, the ones it removes and the ones whose edges it changes, so a
+// change to a shared child changes the version of that child even when it
+// was made through another plan. The objects above the child in the other
+// plans are touched too, since they nest its content. The key outlives the object, so a
+// re-created object continues where the deleted one stopped.
+//
+// Versions are counters seeded from the clock: a new version is the current
+// one plus one, or the current time in microseconds if that is larger. They
+// still only ever go up, and they exceed the versions Elasticsearch assigned
+// to documents indexed before versions were stored.
+func nextVersion(current int64) int64 {
+	next := current + 1
+	if now := time.Now().UnixMicro(); now > next {
+		next = now
+	}
+	return next
+}
+
+func (ps *planService) GraphVersions(c *gin.Context, objectId string) (map[string]int64, error) {
+	ids, err := ps.store.Reachable(c, []string{objectId})
+	if err != nil {
+		return nil, err
+	}
+	return ps.versionsOf(c, ids)
+}
+
+func (ps *planService) GetVersioned(c *gin.Context, objectId string) (map[string]interface{}, map[string]int64, error) {
+	for attempt := 1; ; attempt++ {
+		// Versions only go up, so the document was not written in between
+		// if the versions read before and after it agree
+		before, err := ps.GraphVersions(c, objectId)
+		if err != nil {
+			return nil, nil, err
+		}
+		doc, err := ps.GetAnyObject(c, objectId)
+		if err != nil && err.Error() != "KEY_NOT_FOUND" {
+			return nil, nil, err
+		}
+		after, verr := ps.GraphVersions(c, objectId)
+		if verr != nil {
+			return nil, nil, verr
+		}
+		if sameVersions(before, after) {
+			return doc, after, err
+		}
+		if attempt == writeAttempts {
+			return nil, nil, errors.New("VERSION_CONFLICT")
+		}
+	}
+}
+
+func (ps *planService) Versions(c *gin.Context, doc map[string]interface{}) (map[string]int64, error) {
+	nodes, err := graph.Split(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[string]int64, len(nodes))
+	for _, id := range nodeIds(nodes) {
+		version, err := ps.version(c, id)
+		if err != nil {
+			return nil, err
+		}
+		if version > 0 {
+			versions[id] = version
+		}
+	}
+	return versions, nil
+}
+
+func (ps *planService) version(c *gin.Context, objectId string) (int64, error) {
+	value, err := ps.repo.Get(c, versionKey(objectId))
+	if err != nil {
+		if err.Error() == "KEY_NOT_FOUND" {
+			return 0, nil
+		}
+		log.Printf("Error getting the version of %s from the redis : %v", objectId, err)
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// versionsOf returns the versions of ids, including those never written.
+func (ps *planService) versionsOf(c *gin.Context, ids []string) (map[string]int64, error) {
+	versions := make(map[string]int64, len(ids))
+	for _, id := range ids {
+		version, err := ps.version(c, id)
+		if err != nil {
+			return nil, err
+		}
+		versions[id] = version
+	}
+	return versions, nil
+}
+
+// optimistic runs write until it commits without a concurrent write to the
+// graph of objectId committing first. write gets the versions of the
+// objects the graph held when it was read. With ifVersions set, the graph
+// must still hold exactly these versions and a conflict is not retried,
+// since the caller decided based on what it saw at them. Conflicts fail
+// with VERSION_CONFLICT.
+func (ps *planService) optimistic(c *gin.Context, objectId string, ifVersions map[string]int64, write func(watch func(keys ...string) error, tx repositories.RedisTx, stored map[string]int64) error) error {
+	for attempt := 1; ; attempt++ {
+		err := ps.repo.Watch(c, func(watch func(keys ...string) error, tx repositories.RedisTx) error {
+			stored, err := ps.watchGraph(c, watch, []string{objectId})
+			if err != nil {
+				return err
+			}
+			if ifVersions != nil && !sameVersions(stored, ifVersions) {
+				return errors.New("VERSION_CONFLICT")
+			}
+			return write(watch, tx, stored)
+		})
+		if err == nil || err.Error() != "TX_CONFLICT" {
+			return err
+		}
+		if ifVersions != nil || attempt == writeAttempts {
+			return errors.New("VERSION_CONFLICT")
+		}
+		log.Printf("Write to %s conflicted with a concurrent write, retrying", objectId)
+	}
+}
+
+// watchGraph watches the versions of ids and of every stored object below
+// them, and returns them. Whatever changes one of these objects or its
+// edges changes its version, so nothing read about the graph afterwards can
+// change unnoticed. The graph is read again after each round of watches
+// until it reaches no object that is not watched yet.
+func (ps *planService) watchGraph(c *gin.Context, watch func(keys ...string) error, ids []string) (map[string]int64, error) {
+	watched := make(map[string]bool)
+	for {
+		reachable, err := ps.store.Reachable(c, ids)
+		if err != nil {
+			return nil, err
+		}
+
+		keys := make([]string, 0)
+		for _, id := range reachable {
+			if !watched[id] {
+				watched[id] = true
+				keys = append(keys, versionKey(id))
+			}
+		}
+		if len(keys) == 0 {
+			return ps.versionsOf(c, reachable)
+		}
+		if err := watch(keys...); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// watchDocument watches the stored graph below every object of doc, which
+// Save reads to find out what the write replaces.
+func (ps *planService) watchDocument(c *gin.Context, watch func(keys ...string) error, doc map[string]interface{}) error {
+	nodes, err := graph.Split(doc)
+	if err != nil {
+		return err
+	}
+	_, err = ps.watchGraph(c, watch, nodeIds(nodes))
+	return err
+}
+
+// bumpVersions watches the versions of ids, queues their next values on tx
+// and returns them.
+func (ps *planService) bumpVersions(c *gin.Context, watch func(keys ...string) error, tx repositories.RedisTx, ids []string) (map[string]int64, error) {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = versionKey(id)
+	}
+	if err := watch(keys...); err != nil {
+		return nil, err
+	}
+
+	versions := make(map[string]int64, len(ids))
+	for _, id := range ids {
+		if _, ok := versions[id]; ok {
+			continue
+		}
+		current, err := ps.version(c, id)
+		if err != nil {
+			return nil, err
+		}
+		versions[id] = nextVersion(current)
+		tx.Set(versionKey(id), strconv.FormatInt(versions[id], 10))
+	}
+	return versions, nil
+}
+
+// touched returns the objects a write of nodes over the stored graph
+// changes: the ones it stores and the ones that leave the graph, whose
+// parents change even when something else keeps them.
+func touched(nodes []graph.Node, stored map[string]int64) []string {
+	return append(nodeIds(nodes), departed(nodes, stored)...)
+}
+
+// departed returns the objects of the stored graph that a write of nodes
+// leaves out, sorted.
+func departed(nodes []graph.Node, stored map[string]int64) []string {
+	written := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		written[node.ObjectId] = true
+	}
+	left := make([]string, 0)
+	for id := range stored {
+		if !written[id] {
+			left = append(left, id)
+		}
+	}
+	sort.Strings(left)
+	return left
+}
+
+// sameVersions reports whether a and b hold the same versions, taking
+// missing objects as never written.
+func sameVersions(a, b map[string]int64) bool {
+	for id, version := range a {
+		if b[id] != version {
+			return false
+		}
+	}
+	for id, version := range b {
+		if a[id] != version {
+			return false
+		}
+	}
+	return true
+}
+
+func versionKey(objectId string) string {
+	return "version:" + objectId
+}